@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -8,14 +10,42 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
-	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 
 	"github.com/dhconnelly/rtreego"
 
 	"github.com/ray1729/gpx-utils/pkg/cafes"
 	"github.com/ray1729/gpx-utils/pkg/placenames"
+	"github.com/ray1729/gpx-utils/pkg/rwgps"
+	"github.com/ray1729/gpx-utils/pkg/sources"
 )
 
+// patterns is a flag.Value accumulating repeated glob patterns.
+type patterns []string
+
+func (p *patterns) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *patterns) Set(s string) error {
+	if _, err := filepath.Match(s, ""); err != nil {
+		return fmt.Errorf("invalid pattern %s: %v", s, err)
+	}
+	*p = append(*p, s)
+	return nil
+}
+
+type directoryOptions struct {
+	include   patterns
+	exclude   patterns
+	workers   int
+	force     bool
+	keepGoing bool
+}
+
 func main() {
 	log.SetFlags(0)
 	stopNames := flag.String("stops", "", "Source for refreshment stops")
@@ -24,14 +54,31 @@ func main() {
 	dupDist := flag.Float64("dd", placenames.DefaultGPXSummarizerConfig.PointOfInterestDuplicateDistance, "Suppress recurrences of points of interest within this distance (km)")
 	minDist := flag.Float64("md", placenames.DefaultGPXSummarizerConfig.PointOfInterestMinimumDistance, "Minimum distance (km) between points of interest")
 	minSettlement := flag.String("ms", "Other Settlement", "Exclude populated places smaller than this (City, Town, Village, Hamlet, Other Settlement)")
+	var opts directoryOptions
+	flag.Var(&opts.include, "include", "In directory mode, analyze files matching this glob pattern (may be repeated, default *.gpx)")
+	flag.Var(&opts.exclude, "exclude", "In directory mode, skip files and directories matching this glob pattern (may be repeated)")
+	flag.IntVar(&opts.workers, "j", runtime.NumCPU(), "In directory mode, number of files to analyze in parallel")
+	flag.BoolVar(&opts.force, "force", false, "In directory mode, analyze files even if the summary is newer than the GPX file")
+	flag.BoolVar(&opts.keepGoing, "keep-going", false, "In directory mode, continue after errors and report the failures at the end")
 	flag.Parse()
 	if flag.NArg() != 1 {
-		log.Fatal("Usage: %s [--stops=ctccambridge|cyclingmaps] [--min-dist X] [--min-settlement S] GPX_FILE_OR_DIRECTORY")
+		log.Fatalf("Usage: %s [--stops=ctccambridge|cyclingmaps] [--min-dist X] [--min-settlement S] GPX_FILE_OR_DIRECTORY_OR_URL", os.Args[0])
+	}
+	if len(opts.include) == 0 {
+		opts.include = patterns{"*.gpx"}
+	}
+	if opts.workers < 1 {
+		opts.workers = 1
 	}
 	inFile := flag.Arg(0)
-	info, err := os.Stat(inFile)
-	if err != nil {
-		log.Fatal(err)
+	isURL := strings.HasPrefix(inFile, "http://") || strings.HasPrefix(inFile, "https://")
+	var info os.FileInfo
+	if !isURL {
+		var err error
+		info, err = os.Stat(inFile)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 	var stops *rtreego.Rtree
 	if *stopNames != "" {
@@ -51,9 +98,12 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	if info.IsDir() {
-		err = summarizeDirectory(gs, stops, inFile)
-	} else {
+	switch {
+	case isURL:
+		err = summarizeURL(gs, stops, inFile)
+	case info.IsDir():
+		err = summarizeDirectory(gs, stops, inFile, opts)
+	default:
 		err = summarizeSingleFile(gs, stops, inFile)
 	}
 	if err != nil {
@@ -61,39 +111,169 @@ func main() {
 	}
 }
 
-func summarizeDirectory(gs *placenames.GPXSummarizer, stops *rtreego.Rtree, dirName string) error {
-	files, err := ioutil.ReadDir(dirName)
-	if err != nil {
-		return err
-	}
-	for _, f := range files {
-		if f.IsDir() || path.Ext(f.Name()) != ".gpx" {
-			continue
-		}
-		filename := path.Join(dirName, f.Name())
-		r, err := os.Open(filename)
+// findGPXFiles walks the directory tree and returns the files matching the include patterns
+// and none of the exclude patterns. Patterns are matched against both the base name and
+// the path relative to dirName.
+func findGPXFiles(dirName string, opts directoryOptions) ([]string, error) {
+	var files []string
+	err := filepath.Walk(dirName, func(filename string, info os.FileInfo, err error) error {
 		if err != nil {
-			return fmt.Errorf("error opening %s for reading: %v", filename, err)
+			return err
 		}
-		log.Printf("Analyzing %s", filename)
-		summary, err := gs.SummarizeTrack(r, stops)
+		rel, err := filepath.Rel(dirName, filename)
 		if err != nil {
-			return fmt.Errorf("error creating summary of GPX track %s: %v", filename, err)
+			return err
 		}
-		outfile := filename[:len(filename)-4] + ".json"
-		wc, err := os.OpenFile(outfile, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
-		if err != nil {
-			return fmt.Errorf("error creating output file %s: %v", outfile, err)
+		if rel != "." && matchAny(opts.exclude, rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
 		}
-		err = writeSummary(summary, wc)
-		if err != nil {
-			wc.Close()
-			return fmt.Errorf("error marshalling JSON to %s: %v", outfile, err)
+		if !info.IsDir() && matchAny(opts.include, rel) {
+			files = append(files, filename)
+		}
+		return nil
+	})
+	return files, err
+}
+
+func matchAny(ps patterns, rel string) bool {
+	for _, p := range ps {
+		if ok, _ := filepath.Match(p, filepath.Base(rel)); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(p, rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func outputFilename(filename string) string {
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + ".json"
+}
+
+// upToDate returns true if the summary of filename exists and is newer than filename.
+func upToDate(filename string) bool {
+	in, err := os.Stat(filename)
+	if err != nil {
+		return false
+	}
+	out, err := os.Stat(outputFilename(filename))
+	if err != nil {
+		return false
+	}
+	return out.ModTime().After(in.ModTime())
+}
+
+type failure struct {
+	filename string
+	err      error
+}
+
+// summarizeDirectory analyzes the GPX files under dirName using a pool of workers sharing
+// gs, writing each summary alongside its GPX file. Unless opts.keepGoing is set, no further
+// files are started after the first error.
+func summarizeDirectory(gs *placenames.GPXSummarizer, stops *rtreego.Rtree, dirName string, opts directoryOptions) error {
+	files, err := findGPXFiles(dirName, opts)
+	if err != nil {
+		return err
+	}
+	var todo []string
+	for _, filename := range files {
+		if opts.force || !upToDate(filename) {
+			todo = append(todo, filename)
 		}
-		if err = wc.Close(); err != nil {
-			return fmt.Errorf("error closing file %s: %v", outfile, err)
+	}
+	log.Printf("Found %d GPX files, %d to analyze", len(files), len(todo))
+
+	jobs := make(chan string)
+	var mu sync.Mutex
+	var failures []failure
+	done := 0
+	abort := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < opts.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for filename := range jobs {
+				err := summarizeFile(gs, stops, filename)
+				mu.Lock()
+				done++
+				if err != nil {
+					log.Printf("[%d/%d] %v", done, len(todo), err)
+					if len(failures) == 0 && !opts.keepGoing {
+						close(abort)
+					}
+					failures = append(failures, failure{filename, err})
+				} else {
+					log.Printf("[%d/%d] Analyzed %s", done, len(todo), filename)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+feed:
+	for _, filename := range todo {
+		select {
+		case jobs <- filename:
+		case <-abort:
+			break feed
 		}
 	}
+	close(jobs)
+	wg.Wait()
+
+	if len(failures) == 0 {
+		return nil
+	}
+	if !opts.keepGoing {
+		return failures[0].err
+	}
+	log.Printf("Failed to analyze %d of %d files:", len(failures), len(todo))
+	for _, f := range failures {
+		log.Printf("  %s: %v", f.filename, f.err)
+	}
+	return fmt.Errorf("%d files failed", len(failures))
+}
+
+func summarizeFile(gs *placenames.GPXSummarizer, stops *rtreego.Rtree, filename string) error {
+	r, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("error opening %s for reading: %v", filename, err)
+	}
+	defer r.Close()
+	summary, err := gs.SummarizeTrack(r, stops)
+	if err != nil {
+		return fmt.Errorf("error creating summary of GPX track %s: %v", filename, err)
+	}
+	outfile := outputFilename(filename)
+	// Write to a temporary file and rename it, so that a failed write does not leave a
+	// partial summary that looks newer than the GPX file
+	wc, err := ioutil.TempFile(filepath.Dir(outfile), filepath.Base(outfile)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error creating output file %s: %v", outfile, err)
+	}
+	err = writeSummary(summary, wc)
+	if err != nil {
+		wc.Close()
+		os.Remove(wc.Name())
+		return fmt.Errorf("error marshalling JSON to %s: %v", outfile, err)
+	}
+	if err = wc.Close(); err != nil {
+		os.Remove(wc.Name())
+		return fmt.Errorf("error closing file %s: %v", outfile, err)
+	}
+	if err = os.Chmod(wc.Name(), 0644); err != nil {
+		os.Remove(wc.Name())
+		return fmt.Errorf("error setting permissions of %s: %v", outfile, err)
+	}
+	if err = os.Rename(wc.Name(), outfile); err != nil {
+		os.Remove(wc.Name())
+		return fmt.Errorf("error renaming output file %s: %v", outfile, err)
+	}
 	return nil
 }
 
@@ -102,6 +282,7 @@ func summarizeSingleFile(gs *placenames.GPXSummarizer, stops *rtreego.Rtree, fil
 	if err != nil {
 		return fmt.Errorf("error opening %s for reading: %v", filename, err)
 	}
+	defer r.Close()
 	summary, err := gs.SummarizeTrack(r, stops)
 	if err != nil {
 		return fmt.Errorf("error creating summary of GPX track %s: %v", filename, err)
@@ -112,6 +293,29 @@ func summarizeSingleFile(gs *placenames.GPXSummarizer, stops *rtreego.Rtree, fil
 	return nil
 }
 
+// summarizeURL fetches a route from RideWithGPS, Komoot, Strava or Garmin Connect and writes
+// its summary to stdout. Credentials for the services are read from the environment.
+func summarizeURL(gs *placenames.GPXSummarizer, stops *rtreego.Rtree, rawURL string) error {
+	registry := sources.FromEnv(nil, 0)
+	registry.Register(rwgps.NewClientFromEnv())
+	src, id, err := registry.ForURL(rawURL)
+	if err != nil {
+		return err
+	}
+	data, err := src.FetchGPX(context.Background(), id)
+	if err != nil {
+		return fmt.Errorf("error fetching %s: %v", rawURL, err)
+	}
+	summary, err := gs.SummarizeTrack(bytes.NewReader(data), stops)
+	if err != nil {
+		return fmt.Errorf("error creating summary of GPX track %s: %v", rawURL, err)
+	}
+	if err = writeSummary(summary, os.Stdout); err != nil {
+		return fmt.Errorf("error marshalling summary for %s: %v", rawURL, err)
+	}
+	return nil
+}
+
 func writeSummary(s *placenames.TrackSummary, w io.Writer) error {
 	enc := json.NewEncoder(w)
 	enc.SetIndent("", "    ")
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/dhconnelly/rtreego"
+	"github.com/twpayne/go-gpx"
+
+	"github.com/ray1729/gpx-utils/pkg/cafes"
+	"github.com/ray1729/gpx-utils/pkg/placenames"
+)
+
+// bench-summarize measures the throughput of GPXSummarizer and checks that it gives the same
+// results when shared between goroutines. Build it with -race to check for data races:
+//
+//	go run -race ./cmd/bench-summarize -n 2 ROUTE.gpx...
+func main() {
+	log.SetFlags(0)
+	workers := flag.Int("j", runtime.NumCPU(), "Number of goroutines sharing the summarizer")
+	iterations := flag.Int("n", 10, "Number of times each goroutine summarizes each track")
+	stopNames := flag.String("stops", "", "Source for refreshment stops")
+	flag.Parse()
+	if flag.NArg() < 1 {
+		log.Fatalf("Usage: %s [-j N] [-n N] [-stops NAME] GPX_FILE...", os.Args[0])
+	}
+	var stops *rtreego.Rtree
+	if *stopNames != "" {
+		var err error
+		stops, err = cafes.New().Get(*stopNames)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	gs, err := placenames.NewGPXSummarizer()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var tracks [][]byte
+	points := 0
+	for _, filename := range flag.Args() {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			log.Fatal(err)
+		}
+		g, err := gpx.Read(bytes.NewReader(data))
+		if err != nil {
+			log.Fatalf("error reading GPS track %s: %v", filename, err)
+		}
+		for _, trk := range g.Trk {
+			for _, seg := range trk.TrkSeg {
+				points += len(seg.TrkPt)
+			}
+		}
+		tracks = append(tracks, data)
+	}
+
+	// Summarize each track once serially to obtain the expected results.
+	expected := make([]*placenames.TrackSummary, len(tracks))
+	start := time.Now()
+	for i, data := range tracks {
+		expected[i], err = gs.SummarizeTrack(bytes.NewReader(data), stops)
+		if err != nil {
+			log.Fatalf("error summarizing %s: %v", flag.Arg(i), err)
+		}
+	}
+	report("Serial", points, time.Since(start))
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var mismatches int
+	start = time.Now()
+	for w := 0; w < *workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < *iterations; n++ {
+				for i, data := range tracks {
+					s, err := gs.SummarizeTrack(bytes.NewReader(data), stops)
+					if err != nil || !reflect.DeepEqual(s, expected[i]) {
+						mu.Lock()
+						mismatches++
+						mu.Unlock()
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	report(fmt.Sprintf("Parallel (%d goroutines)", *workers), points**workers**iterations, time.Since(start))
+	if mismatches > 0 {
+		log.Fatalf("%d concurrent summaries differed from the serial results", mismatches)
+	}
+	log.Printf("All %d concurrent summaries matched the serial results", len(tracks)**workers**iterations)
+}
+
+func report(label string, points int, elapsed time.Duration) {
+	log.Printf("%s: %d points in %s (%.0f points/s)", label, points, elapsed.Round(time.Millisecond), float64(points)/elapsed.Seconds())
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+type Severity string
+
+const (
+	SeverityInfo    Severity = "info"
+	SeverityWarning Severity = "warning"
+	SeverityError   Severity = "error"
+)
+
+// Anomaly describes a problem found at a point on the route. Repeat is populated for
+// repeated sections and out-and-back stubs.
+type Anomaly struct {
+	Type        string
+	Severity    Severity
+	Location    Location
+	Description string
+	Repeat      *Repeat `json:",omitempty"`
+
+	// Indices of the points deleted by fixAnomalies, and whether fixAnomalies should
+	// replace the elevation of point by the mean of its neighbours.
+	remove          []int
+	smoothElevation bool
+	point           int
+}
+
+type checkConfig struct {
+	Fuzz             float64 // m
+	MinDistance      float64 // m
+	MaxDistance      float64 // m
+	Gap              float64 // m
+	MaxStub          float64 // m
+	MaxSpeed         float64 // m/s
+	SpikeDistance    float64 // m
+	ElevationSpike   float64 // m
+	MaxTimeGap       time.Duration
+	TeleportDistance float64 // m
+}
+
+var allChecks = []string{"repeats", "stubs", "spikes", "elevation", "time-gaps", "duplicate-timestamps", "zero-length", "teleports"}
+
+// findAnomalies runs the named checks and returns the anomalies found, in route order
+// within each check.
+func findAnomalies(points []RoutePoint, checks []string, conf checkConfig) ([]Anomaly, error) {
+	enabled := make(map[string]bool)
+	for _, c := range checks {
+		valid := false
+		for _, x := range allChecks {
+			if c == x {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("invalid check: %s", c)
+		}
+		enabled[c] = true
+	}
+	var stubs []Repeat
+	if enabled["stubs"] || enabled["repeats"] {
+		stubs = findStubs(points, conf)
+	}
+	var anomalies []Anomaly
+	if enabled["repeats"] {
+		for _, r := range findDuplicates(points, conf.Fuzz, conf.MinDistance, conf.MaxDistance, conf.Gap) {
+			if withinStub(r, stubs) {
+				continue
+			}
+			r := r
+			anomalies = append(anomalies, Anomaly{
+				Type:        "repeat",
+				Severity:    SeverityWarning,
+				Location:    r.Start,
+				Description: fmt.Sprintf("%0.2f km section revisited at %0.2f km", r.Length, r.RevisitStart.Distance),
+				Repeat:      &r,
+				point:       r.i0,
+			})
+		}
+	}
+	if enabled["stubs"] {
+		for _, r := range stubs {
+			r := r
+			var remove []int
+			for i := r.i0 + 1; i <= r.j0; i++ {
+				remove = append(remove, i)
+			}
+			anomalies = append(anomalies, Anomaly{
+				Type:        "stub",
+				Severity:    SeverityWarning,
+				Location:    r.Start,
+				Description: fmt.Sprintf("%0.2f km out-and-back stub", r.RevisitStart.Distance-r.Start.Distance),
+				Repeat:      &r,
+				remove:      remove,
+				point:       r.i0,
+			})
+		}
+	}
+	if enabled["spikes"] {
+		anomalies = append(anomalies, findSpikes(points, conf)...)
+	}
+	if enabled["elevation"] {
+		anomalies = append(anomalies, findElevationSpikes(points, conf)...)
+	}
+	if enabled["time-gaps"] {
+		anomalies = append(anomalies, findTimeGaps(points, conf)...)
+	}
+	if enabled["duplicate-timestamps"] {
+		anomalies = append(anomalies, findDuplicateTimestamps(points)...)
+	}
+	if enabled["zero-length"] {
+		anomalies = append(anomalies, findZeroLengthSegments(points)...)
+	}
+	if enabled["teleports"] {
+		anomalies = append(anomalies, findTeleports(points, conf)...)
+	}
+	return anomalies, nil
+}
+
+// findStubs returns the short out-and-back sections of the route: those where the route is
+// retraced in the opposite direction immediately after the first pass.
+func findStubs(points []RoutePoint, conf checkConfig) []Repeat {
+	var stubs []Repeat
+	for _, r := range findDuplicates(points, conf.Fuzz, 2*conf.Fuzz, 2*conf.MaxStub, conf.Gap) {
+		if r.j1 < r.j0 && r.i1 < r.j1 {
+			stubs = append(stubs, r)
+		}
+	}
+	return stubs
+}
+
+func withinStub(r Repeat, stubs []Repeat) bool {
+	for _, s := range stubs {
+		if s.i0 <= r.i0 && r.i0 <= s.j0 && s.i0 <= r.j0 && r.j0 <= s.j0 {
+			return true
+		}
+	}
+	return false
+}
+
+// findSpikes reports points that are reached at an implausible speed, or that lie far off
+// the line between their neighbours.
+func findSpikes(points []RoutePoint, conf checkConfig) []Anomaly {
+	var anomalies []Anomaly
+	for i := 1; i < len(points)-1; i++ {
+		prev, p, next := points[i-1], points[i], points[i+1]
+		if prev.Segment != p.Segment || next.Segment != p.Segment {
+			continue
+		}
+		dIn := p.Distance - prev.Distance
+		dOut := next.Distance - p.Distance
+		vIn, okIn := speed(prev, p)
+		vOut, okOut := speed(p, next)
+		var desc string
+		switch {
+		case okIn && okOut && vIn > conf.MaxSpeed && vOut > conf.MaxSpeed:
+			desc = fmt.Sprintf("point reached at %0.f km/h", vIn*3.6)
+		case dIn > conf.SpikeDistance && dOut > conf.SpikeDistance &&
+			euclideanDistance(prev.Coordinate, next.Coordinate) < 0.5*minFloat(dIn, dOut):
+			desc = fmt.Sprintf("point %0.f m off the route", minFloat(dIn, dOut))
+		case okIn && vIn > conf.MaxSpeed:
+			anomalies = append(anomalies, Anomaly{
+				Type:        "speed",
+				Severity:    SeverityWarning,
+				Location:    newLocation(p),
+				Description: fmt.Sprintf("%0.f m covered at %0.f km/h", dIn, vIn*3.6),
+				point:       i,
+			})
+			continue
+		default:
+			continue
+		}
+		anomalies = append(anomalies, Anomaly{
+			Type:        "gps-spike",
+			Severity:    SeverityError,
+			Location:    newLocation(p),
+			Description: desc,
+			remove:      []int{i},
+			point:       i,
+		})
+		// The point after a spike is reached at the same implausible speed.
+		i++
+	}
+	return anomalies
+}
+
+// speed returns the speed (m/s) between p and q, and false if it cannot be calculated.
+func speed(p, q RoutePoint) (float64, bool) {
+	if p.Time.IsZero() || q.Time.IsZero() {
+		return 0, false
+	}
+	dt := q.Time.Sub(p.Time).Seconds()
+	if dt <= 0 {
+		return 0, false
+	}
+	return (q.Distance - p.Distance) / dt, true
+}
+
+func minFloat(x, y float64) float64 {
+	if x < y {
+		return x
+	}
+	return y
+}
+
+// findElevationSpikes reports points whose elevation is well above or below both their
+// neighbours in the same track segment.
+func findElevationSpikes(points []RoutePoint, conf checkConfig) []Anomaly {
+	var anomalies []Anomaly
+	for i := 1; i < len(points)-1; i++ {
+		if points[i-1].Segment != points[i].Segment || points[i+1].Segment != points[i].Segment {
+			continue
+		}
+		up := points[i].Ele - points[i-1].Ele
+		down := points[i].Ele - points[i+1].Ele
+		if (up > conf.ElevationSpike && down > conf.ElevationSpike) || (up < -conf.ElevationSpike && down < -conf.ElevationSpike) {
+			anomalies = append(anomalies, Anomaly{
+				Type:            "elevation-spike",
+				Severity:        SeverityWarning,
+				Location:        newLocation(points[i]),
+				Description:     fmt.Sprintf("elevation jumps by %0.f m", up),
+				smoothElevation: true,
+				point:           i,
+			})
+		}
+	}
+	return anomalies
+}
+
+func findTimeGaps(points []RoutePoint, conf checkConfig) []Anomaly {
+	var anomalies []Anomaly
+	for i := 1; i < len(points); i++ {
+		p, q := points[i-1], points[i]
+		if p.Time.IsZero() || q.Time.IsZero() {
+			continue
+		}
+		if dt := q.Time.Sub(p.Time); dt > conf.MaxTimeGap {
+			anomalies = append(anomalies, Anomaly{
+				Type:        "time-gap",
+				Severity:    SeverityInfo,
+				Location:    newLocation(p),
+				Description: fmt.Sprintf("no points recorded for %s", dt),
+				point:       i - 1,
+			})
+		}
+	}
+	return anomalies
+}
+
+func findDuplicateTimestamps(points []RoutePoint) []Anomaly {
+	var anomalies []Anomaly
+	for i := 1; i < len(points); i++ {
+		p, q := points[i-1], points[i]
+		if !q.Time.IsZero() && q.Time.Equal(p.Time) {
+			anomalies = append(anomalies, Anomaly{
+				Type:        "duplicate-timestamp",
+				Severity:    SeverityInfo,
+				Location:    newLocation(q),
+				Description: fmt.Sprintf("two points recorded at %s", q.Time.Format(time.RFC3339)),
+				remove:      []int{i},
+				point:       i,
+			})
+		}
+	}
+	return anomalies
+}
+
+func findZeroLengthSegments(points []RoutePoint) []Anomaly {
+	var anomalies []Anomaly
+	for i := 1; i < len(points); i++ {
+		p, q := points[i-1], points[i]
+		if p.Segment == q.Segment && q.Distance == p.Distance {
+			anomalies = append(anomalies, Anomaly{
+				Type:        "zero-length",
+				Severity:    SeverityInfo,
+				Location:    newLocation(q),
+				Description: "point repeats the previous point",
+				remove:      []int{i},
+				point:       i,
+			})
+		}
+	}
+	return anomalies
+}
+
+// findTeleports reports track segments that start far from the end of the previous segment.
+func findTeleports(points []RoutePoint, conf checkConfig) []Anomaly {
+	var anomalies []Anomaly
+	for i := 1; i < len(points); i++ {
+		p, q := points[i-1], points[i]
+		if p.Segment == q.Segment {
+			continue
+		}
+		if d := euclideanDistance(p.Coordinate, q.Coordinate); d > conf.TeleportDistance {
+			anomalies = append(anomalies, Anomaly{
+				Type:        "teleport",
+				Severity:    SeverityError,
+				Location:    newLocation(q),
+				Description: fmt.Sprintf("track segment starts %0.2f km from the end of the previous one", d/1000.0),
+				point:       i,
+			})
+		}
+	}
+	return anomalies
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fofanov/go-osgb"
+	"github.com/twpayne/go-gpx"
+)
+
+var testConfig = checkConfig{
+	Fuzz:             5,
+	MinDistance:      100,
+	MaxDistance:      5000,
+	Gap:              500,
+	MaxStub:          500,
+	MaxSpeed:         100 / 3.6,
+	SpikeDistance:    100,
+	ElevationSpike:   25,
+	MaxTimeGap:       5 * time.Minute,
+	TeleportDistance: 200,
+}
+
+var testStart = time.Date(2025, 6, 1, 10, 0, 0, 0, time.UTC)
+
+// trackPoint is a point of a constructed track, recorded t after testStart.
+type trackPoint struct {
+	x, y, ele float64
+	t         time.Duration
+	seg       int
+	untimed   bool
+}
+
+// straight returns n points heading east 10 m apart at 18 km/h, in one segment.
+func straight(n int) []trackPoint {
+	var tps []trackPoint
+	for i := 0; i < n; i++ {
+		tps = append(tps, trackPoint{x: 1000 + 10*float64(i), y: 1000, ele: 10, t: time.Duration(2*i) * time.Second})
+	}
+	return tps
+}
+
+// newTrack returns a GPX track and its route points as readGPXTrack would.
+func newTrack(tps []trackPoint) (*gpx.GPX, []RoutePoint) {
+	trk := &gpx.TrkType{}
+	var points []RoutePoint
+	for i, tp := range tps {
+		if i == 0 || tp.seg != tps[i-1].seg {
+			trk.TrkSeg = append(trk.TrkSeg, &gpx.TrkSegType{})
+		}
+		seg := trk.TrkSeg[len(trk.TrkSeg)-1]
+		w := &gpx.WptType{Ele: tp.ele}
+		if !tp.untimed {
+			w.Time = testStart.Add(tp.t)
+		}
+		seg.TrkPt = append(seg.TrkPt, w)
+		p := RoutePoint{
+			WptType:    w,
+			Segment:    tp.seg,
+			Coordinate: &osgb.OSGB36Coordinate{Easting: tp.x, Northing: tp.y},
+		}
+		if i > 0 {
+			prev := points[i-1]
+			p.Distance = prev.Distance + euclideanDistance(prev.Coordinate, p.Coordinate)
+		}
+		points = append(points, p)
+	}
+	return &gpx.GPX{Trk: []*gpx.TrkType{trk}}, points
+}
+
+// found is an anomaly of the given type at a point.
+type found struct {
+	Type  string
+	Point int
+}
+
+func TestFindAnomalies(t *testing.T) {
+	tests := []struct {
+		name   string
+		checks string
+		track  func() []trackPoint
+		want   []found
+	}{
+		{
+			name:   "clean track",
+			checks: strings.Join(allChecks, ","),
+			track:  func() []trackPoint { return straight(20) },
+		},
+		{
+			name:   "GPS spike",
+			checks: "spikes",
+			track: func() []trackPoint {
+				tps := straight(10)
+				tps[5].y += 500
+				return tps
+			},
+			want: []found{{"gps-spike", 5}},
+		},
+		{
+			name:   "elevation spike",
+			checks: "elevation",
+			track: func() []trackPoint {
+				tps := straight(10)
+				tps[5].ele = 60
+				return tps
+			},
+			want: []found{{"elevation-spike", 5}},
+		},
+		{
+			// Each segment may be recorded by a different device; only compare within one.
+			name:   "elevation change between segments",
+			checks: "elevation",
+			track: func() []trackPoint {
+				tps := straight(10)
+				tps[5].ele = 100
+				for i := 5; i < len(tps); i++ {
+					tps[i].seg++
+				}
+				for i := 6; i < len(tps); i++ {
+					tps[i].seg++
+				}
+				return tps
+			},
+		},
+		{
+			// A 90 m detour north and back, which repeats and stubs both find.
+			name:   "stub",
+			checks: "repeats,stubs",
+			track: func() []trackPoint {
+				tps := straight(31)
+				last := tps[30]
+				for d := 10.0; d <= 100; d += 10 {
+					last.y, last.t = 1000+d, last.t+2*time.Second
+					tps = append(tps, last)
+				}
+				for d := 90.0; d >= 10; d -= 10 {
+					last.y, last.t = 1000+d, last.t+2*time.Second
+					tps = append(tps, last)
+				}
+				for i := 1; i <= 10; i++ {
+					last.x, last.y, last.t = last.x+10, 1000, last.t+2*time.Second
+					tps = append(tps, last)
+				}
+				return tps
+			},
+			want: []found{{"stub", 31}},
+		},
+		{
+			name:   "time gap",
+			checks: "time-gaps",
+			track: func() []trackPoint {
+				tps := straight(10)
+				for i := 5; i < len(tps); i++ {
+					tps[i].t += 10 * time.Minute
+				}
+				return tps
+			},
+			want: []found{{"time-gap", 4}},
+		},
+		{
+			name:   "duplicate timestamp",
+			checks: "duplicate-timestamps",
+			track: func() []trackPoint {
+				tps := straight(10)
+				tps[5].t = tps[4].t
+				return tps
+			},
+			want: []found{{"duplicate-timestamp", 5}},
+		},
+		{
+			name:   "no timestamps",
+			checks: "duplicate-timestamps,time-gaps",
+			track: func() []trackPoint {
+				tps := straight(10)
+				for i := range tps {
+					tps[i].untimed = true
+				}
+				return tps
+			},
+		},
+		{
+			name:   "zero-length",
+			checks: "zero-length",
+			track: func() []trackPoint {
+				tps := straight(10)
+				tps[5].x = tps[4].x
+				tps[8].x, tps[8].seg, tps[9].seg = tps[7].x, 1, 1
+				return tps
+			},
+			want: []found{{"zero-length", 5}},
+		},
+		{
+			name:   "teleport",
+			checks: "teleports",
+			track: func() []trackPoint {
+				tps := straight(15)
+				for i := 5; i < len(tps); i++ {
+					tps[i].seg = 1
+					tps[i].x += 50
+				}
+				for i := 10; i < len(tps); i++ {
+					tps[i].seg = 2
+					tps[i].y += 1000
+				}
+				return tps
+			},
+			want: []found{{"teleport", 10}},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, points := newTrack(tc.track())
+			anomalies, err := findAnomalies(points, strings.Split(tc.checks, ","), testConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []found
+			for _, a := range anomalies {
+				got = append(got, found{a.Type, a.point})
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFindAnomaliesInvalidCheck(t *testing.T) {
+	_, points := newTrack(straight(10))
+	if _, err := findAnomalies(points, []string{"spikes", "bogus"}, testConfig); err == nil {
+		t.Error("expected an error for an invalid check")
+	}
+}
+
+func TestFixAnomalies(t *testing.T) {
+	tps := straight(20)
+	tps[5].y += 500
+	tps[12].ele = 60
+	tps[16].t = tps[15].t
+	g, points := newTrack(tps)
+	spike, duplicate := points[5].WptType, points[16].WptType
+	anomalies, err := findAnomalies(points, allChecks, testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := fixAnomalies(g, points, anomalies); n != 3 {
+		t.Errorf("fixed %d points, want 3", n)
+	}
+	kept := g.Trk[0].TrkSeg[0].TrkPt
+	if len(kept) != 18 {
+		t.Fatalf("kept %d points, want 18", len(kept))
+	}
+	for _, w := range kept {
+		if w == spike || w == duplicate {
+			t.Errorf("point at %s was not removed", w.Time.Format(time.RFC3339))
+		}
+		if w.Ele != 10 {
+			t.Errorf("point at %s has elevation %.f, want 10", w.Time.Format(time.RFC3339), w.Ele)
+		}
+	}
+}
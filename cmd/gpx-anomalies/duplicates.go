@@ -0,0 +1,156 @@
+package main
+
+import (
+	"math"
+	"sort"
+
+	"github.com/fofanov/go-osgb"
+)
+
+// Location identifies a point on the route.
+type Location struct {
+	Lat      float64
+	Lon      float64
+	Easting  float64
+	Northing float64
+	Distance float64 // km from the start of the route
+}
+
+func newLocation(p RoutePoint) Location {
+	return Location{
+		Lat:      p.Lat,
+		Lon:      p.Lon,
+		Easting:  p.Coordinate.Easting,
+		Northing: p.Coordinate.Northing,
+		Distance: p.Distance / 1000.0,
+	}
+}
+
+// Repeat describes a section of the route that is ridden a second time. Start and End
+// are the ends of the section on the first pass, RevisitStart and RevisitEnd the
+// corresponding points on the second pass.
+type Repeat struct {
+	Start        Location
+	End          Location
+	RevisitStart Location
+	RevisitEnd   Location
+	Length       float64 // km
+
+	i0, i1, j0, j1 int // indices of Start, End, RevisitStart and RevisitEnd
+}
+
+// findDuplicates returns the sections of the route that are revisited between minDist
+// and maxDist metres further along. Points are considered coincident if they are within
+// fuzz metres of each other. Matches separated by more than gap metres are reported as
+// separate repeats.
+func findDuplicates(points []RoutePoint, fuzz, minDist, maxDist, gap float64) []Repeat {
+	index := newGridIndex(points, fuzz)
+	var repeats []Repeat
+	var open bool
+	var i0, i1, j0, j1 int
+	closeRepeat := func() {
+		repeats = append(repeats, Repeat{
+			Start:        newLocation(points[i0]),
+			End:          newLocation(points[i1]),
+			RevisitStart: newLocation(points[j0]),
+			RevisitEnd:   newLocation(points[j1]),
+			Length:       (points[i1].Distance - points[i0].Distance) / 1000.0,
+			i0:           i0,
+			i1:           i1,
+			j0:           j0,
+			j1:           j1,
+		})
+		open = false
+	}
+	for i, p := range points {
+		// When extending a repeat, prefer the match that continues the second pass;
+		// otherwise take the earliest revisit. Matches arrive in grid order, not route order.
+		j := -1
+		index.near(points, i, fuzz, minDist, maxDist, func(k int) {
+			if j < 0 {
+				j = k
+				return
+			}
+			if open {
+				dk := math.Abs(points[k].Distance - points[j1].Distance)
+				dj := math.Abs(points[j].Distance - points[j1].Distance)
+				if dk < dj || (dk == dj && k < j) {
+					j = k
+				}
+			} else if k < j {
+				j = k
+			}
+		})
+		if open {
+			step := p.Distance - points[i1].Distance
+			if step > gap || (j >= 0 && math.Abs(points[j].Distance-points[j1].Distance) > gap+step) {
+				closeRepeat()
+			}
+		}
+		if j < 0 {
+			continue
+		}
+		if open {
+			i1, j1 = i, j
+		} else {
+			i0, i1, j0, j1 = i, i, j, j
+			open = true
+		}
+	}
+	if open {
+		closeRepeat()
+	}
+	return repeats
+}
+
+type gridCell struct {
+	x, y int64
+}
+
+// gridIndex buckets route points into square cells so each point need only be compared
+// with points in the neighbouring cells. Cells hold point indices in route order.
+type gridIndex struct {
+	size  float64
+	cells map[gridCell][]int
+}
+
+func newGridIndex(points []RoutePoint, size float64) *gridIndex {
+	if size < 1.0 {
+		size = 1.0
+	}
+	g := &gridIndex{size: size, cells: make(map[gridCell][]int)}
+	for i, p := range points {
+		c := g.cell(p.Coordinate)
+		g.cells[c] = append(g.cells[c], i)
+	}
+	return g
+}
+
+func (g *gridIndex) cell(c *osgb.OSGB36Coordinate) gridCell {
+	return gridCell{int64(math.Floor(c.Easting / g.size)), int64(math.Floor(c.Northing / g.size))}
+}
+
+// near calls f with the index of each point within fuzz metres of points[i] that appears
+// more than minDist and less than maxDist metres further along the route. Points are
+// visited cell by cell, so are only in route order within each cell.
+func (g *gridIndex) near(points []RoutePoint, i int, fuzz, minDist, maxDist float64, f func(int)) {
+	p := points[i]
+	c := g.cell(p.Coordinate)
+	for dx := int64(-1); dx <= 1; dx++ {
+		for dy := int64(-1); dy <= 1; dy++ {
+			xs := g.cells[gridCell{c.x + dx, c.y + dy}]
+			k := sort.Search(len(xs), func(n int) bool {
+				return points[xs[n]].Distance-p.Distance > minDist
+			})
+			for ; k < len(xs); k++ {
+				q := points[xs[k]]
+				if q.Distance-p.Distance >= maxDist {
+					break
+				}
+				if euclideanDistance(p.Coordinate, q.Coordinate) < fuzz {
+					f(xs[k])
+				}
+			}
+		}
+	}
+}
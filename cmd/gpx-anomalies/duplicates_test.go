@@ -0,0 +1,125 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/fofanov/go-osgb"
+	"github.com/twpayne/go-gpx"
+)
+
+// xy is a position on the National Grid, in metres.
+type xy struct {
+	x, y float64
+}
+
+// newRoute returns a single-segment route through the given positions.
+func newRoute(positions []xy) []RoutePoint {
+	var points []RoutePoint
+	for i, pos := range positions {
+		p := RoutePoint{
+			WptType:    &gpx.WptType{},
+			Coordinate: &osgb.OSGB36Coordinate{Easting: pos.x, Northing: pos.y},
+		}
+		if i > 0 {
+			prev := points[i-1]
+			p.Distance = prev.Distance + euclideanDistance(prev.Coordinate, p.Coordinate)
+		}
+		points = append(points, p)
+	}
+	return points
+}
+
+// loop returns laps of a 100 m square with a point every 10 m, each lap shifted east by
+// the corresponding offset.
+func loop(x0, y0 float64, offsets ...float64) []xy {
+	var positions []xy
+	for _, dx := range offsets {
+		for s := 0.0; s < 400; s += 10 {
+			var p xy
+			switch {
+			case s < 100:
+				p = xy{s, 0}
+			case s < 200:
+				p = xy{100, s - 100}
+			case s < 300:
+				p = xy{300 - s, 100}
+			default:
+				p = xy{0, 400 - s}
+			}
+			positions = append(positions, xy{x0 + dx + p.x, y0 + p.y})
+		}
+	}
+	return positions
+}
+
+// outAndBack returns a 500 m ride east with a point every 10 m, returning dy metres to the
+// north of the outward leg.
+func outAndBack(x0, y0, dy float64) []xy {
+	var positions []xy
+	for x := 0.0; x <= 500; x += 10 {
+		positions = append(positions, xy{x0 + x, y0})
+	}
+	for x := 490.0; x >= 0; x -= 10 {
+		positions = append(positions, xy{x0 + x, y0 + dy})
+	}
+	return positions
+}
+
+func TestFindDuplicates(t *testing.T) {
+	tests := []struct {
+		name      string
+		positions []xy
+		fuzz      float64
+		want      [][4]float64 // km along the route of Start, End, RevisitStart and RevisitEnd
+	}{
+		{
+			name:      "loop ridden once",
+			positions: loop(1002.5, 1000, 0),
+			fuzz:      5,
+		},
+		{
+			// The second lap lies in the same cells as the first and the third lap in the
+			// cells to the west, which are searched first.
+			name:      "loop ridden three times",
+			positions: loop(1000.5, 1000, 0, 2, -2),
+			fuzz:      5,
+			want:      [][4]float64{{0, 0.79, 0.40, 1.19}},
+		},
+		{
+			name:      "out and back",
+			positions: outAndBack(1000, 1000, 0),
+			fuzz:      5,
+			want:      [][4]float64{{0, 0.44, 1.0, 0.56}},
+		},
+		{
+			// A fuzz below 1 m is searched with 1 m cells; the return leg is in the next row.
+			name:      "out and back with fuzz under 1 m",
+			positions: outAndBack(1000, 1000.8, 0.3),
+			fuzz:      0.5,
+			want:      [][4]float64{{0, 0.44, 1.0, 0.56}},
+		},
+		{
+			name:      "out and back apart by more than fuzz",
+			positions: outAndBack(1000, 1000.8, 0.7),
+			fuzz:      0.5,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			repeats := findDuplicates(newRoute(tc.positions), tc.fuzz, 100, 5000, 500)
+			if len(repeats) != len(tc.want) {
+				t.Fatalf("got %d repeats, want %d: %+v", len(repeats), len(tc.want), repeats)
+			}
+			for i, r := range repeats {
+				got := [4]float64{r.Start.Distance, r.End.Distance, r.RevisitStart.Distance, r.RevisitEnd.Distance}
+				for k := range got {
+					if math.Abs(got[k]-tc.want[i][k]) > 0.015 {
+						t.Errorf("repeat %d: got %.3f, want %.2f", i, got, tc.want[i])
+						break
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+
+	"github.com/twpayne/go-gpx"
+)
+
+// fixAnomalies modifies g in place, deleting spikes, stubs and redundant points and
+// smoothing elevation spikes. It returns the number of points deleted or corrected.
+func fixAnomalies(g *gpx.GPX, points []RoutePoint, anomalies []Anomaly) int {
+	remove := make(map[*gpx.WptType]bool)
+	smoothed := 0
+	for _, a := range anomalies {
+		for _, i := range a.remove {
+			remove[points[i].WptType] = true
+		}
+		if a.smoothElevation {
+			i := a.point
+			points[i].Ele = (points[i-1].Ele + points[i+1].Ele) / 2
+			smoothed++
+		}
+	}
+	for _, trk := range g.Trk {
+		for _, seg := range trk.TrkSeg {
+			kept := seg.TrkPt[:0]
+			for _, p := range seg.TrkPt {
+				if !remove[p] {
+					kept = append(kept, p)
+				}
+			}
+			seg.TrkPt = kept
+		}
+	}
+	return len(remove) + smoothed
+}
+
+func writeGPXFile(w io.Writer, g *gpx.GPX) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	return g.WriteIndent(w, "", "  ")
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"math"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/fofanov/go-osgb"
 	"github.com/twpayne/go-gpx"
@@ -15,7 +18,7 @@ func main() {
 	log.SetFlags(0)
 	app := &cli.App{
 		Name:  "gpx-anomalies",
-		Usage: "Find repeated points in a GPX track",
+		Usage: "Find anomalies such as repeated sections, spikes and gaps in a GPX track",
 		Flags: []cli.Flag{
 			&cli.StringFlag{
 				Name:     "gpx-file",
@@ -23,6 +26,11 @@ func main() {
 				Usage:    "Name of GPX file to process",
 				Required: true,
 			},
+			&cli.StringFlag{
+				Name:  "checks",
+				Usage: "Comma-separated list of checks to run (" + strings.Join(allChecks, ", ") + ")",
+				Value: strings.Join(allChecks, ","),
+			},
 			&cli.Float64Flag{
 				Name:    "fuzz",
 				Aliases: []string{"f"},
@@ -41,19 +49,90 @@ func main() {
 				Usage:   "Do not show repeats that appear more than MAX kilometers apart",
 				Value:   5.0,
 			},
+			&cli.Float64Flag{
+				Name:  "gap",
+				Usage: "Report revisits more than GAP kilometres apart as separate repeated sections",
+				Value: 0.5,
+			},
+			&cli.Float64Flag{
+				Name:  "max-stub",
+				Usage: "Report out-and-back sections shorter than MAX-STUB kilometres each way as stubs",
+				Value: 0.5,
+			},
+			&cli.Float64Flag{
+				Name:  "max-speed",
+				Usage: "Report points reached faster than MAX-SPEED km/h as GPS spikes",
+				Value: 100.0,
+			},
+			&cli.Float64Flag{
+				Name:  "spike-distance",
+				Usage: "Report points more than SPIKE-DISTANCE kilometres off an otherwise straight line as GPS spikes",
+				Value: 0.1,
+			},
+			&cli.Float64Flag{
+				Name:  "elevation-spike",
+				Usage: "Report points more than ELEVATION-SPIKE metres above or below both neighbours",
+				Value: 25.0,
+			},
+			&cli.DurationFlag{
+				Name:  "max-time-gap",
+				Usage: "Report gaps in recording longer than MAX-TIME-GAP",
+				Value: 5 * time.Minute,
+			},
+			&cli.Float64Flag{
+				Name:  "teleport-distance",
+				Usage: "Report track segments starting more than TELEPORT-DISTANCE kilometres from the end of the previous one",
+				Value: 0.2,
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Usage: "Output format (text, json or gpx)",
+				Value: "text",
+			},
+			&cli.StringFlag{
+				Name:    "output",
+				Aliases: []string{"o"},
+				Usage:   "Write the report to this file instead of STDOUT",
+			},
+			&cli.StringFlag{
+				Name:  "fix",
+				Usage: "Write a copy of the track with fixable anomalies removed to this file",
+			},
 		},
 		Action: func(c *cli.Context) error {
-			points, err := readGPXTrack(c.String("gpx-file"))
+			g, points, err := readGPXTrack(c.String("gpx-file"))
 			if err != nil {
 				log.Fatal(err)
 			}
-			findDuplicates(
-				points,
-				c.Float64("fuzz")*1000.0,
-				c.Float64("min-distance")*1000.0,
-				c.Float64("max-distance")*1000.0,
-			)
-			return nil
+			conf := checkConfig{
+				Fuzz:             c.Float64("fuzz") * 1000.0,
+				MinDistance:      c.Float64("min-distance") * 1000.0,
+				MaxDistance:      c.Float64("max-distance") * 1000.0,
+				Gap:              c.Float64("gap") * 1000.0,
+				MaxStub:          c.Float64("max-stub") * 1000.0,
+				MaxSpeed:         c.Float64("max-speed") / 3.6,
+				SpikeDistance:    c.Float64("spike-distance") * 1000.0,
+				ElevationSpike:   c.Float64("elevation-spike"),
+				MaxTimeGap:       c.Duration("max-time-gap"),
+				TeleportDistance: c.Float64("teleport-distance") * 1000.0,
+			}
+			anomalies, err := findAnomalies(points, strings.Split(c.String("checks"), ","), conf)
+			if err != nil {
+				return err
+			}
+			if fixFile := c.String("fix"); fixFile != "" {
+				n := fixAnomalies(g, points, anomalies)
+				log.Printf("Removed or corrected %d points", n)
+				err := writeOutput(fixFile, func(w io.Writer) error {
+					return writeGPXFile(w, g)
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return writeOutput(c.String("output"), func(w io.Writer) error {
+				return writeReport(w, c.String("format"), anomalies)
+			})
 		},
 	}
 	if err := app.Run(os.Args); err != nil {
@@ -62,26 +141,23 @@ func main() {
 
 }
 
-func findDuplicates(points []RoutePoint, fuzz, minDist, maxDist float64) {
-	var lastError *RoutePoint
-	for i := range points {
-		p := points[i]
-		for j := i + 1; j < len(points); j++ {
-			q := points[j]
-			if p.Distance == q.Distance {
-				continue
-			}
-			d := euclideanDistance(p.Coordinate, q.Coordinate)
-			D := q.Distance - p.Distance
-			if d < fuzz && D > minDist && D < maxDist {
-				if lastError == nil || p.Distance-lastError.Distance > 500 {
-					fmt.Printf("Point (%0.f, %0.f) revisited at %0.2f km and %0.2f km\n",
-						p.Coordinate.Easting, p.Coordinate.Northing, p.Distance/1000.0, q.Distance/1000.0)
-				}
-				lastError = &p
-			}
-		}
+// writeOutput calls write with STDOUT, or with the named file if filename is not empty.
+func writeOutput(filename string, write func(io.Writer) error) error {
+	if filename == "" {
+		return write(os.Stdout)
+	}
+	wc, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("error creating output file %s: %v", filename, err)
+	}
+	if err := write(wc); err != nil {
+		wc.Close()
+		return fmt.Errorf("error writing %s: %v", filename, err)
+	}
+	if err := wc.Close(); err != nil {
+		return fmt.Errorf("error closing file %s: %v", filename, err)
 	}
+	return nil
 }
 
 func euclideanDistance(p, q *osgb.OSGB36Coordinate) float64 {
@@ -90,21 +166,22 @@ func euclideanDistance(p, q *osgb.OSGB36Coordinate) float64 {
 	return math.Sqrt(x*x + y*y)
 }
 
-func readGPXTrack(filename string) ([]RoutePoint, error) {
+func readGPXTrack(filename string) (*gpx.GPX, []RoutePoint, error) {
 	r, err := os.Open(filename)
 	if err != nil {
-		return nil, fmt.Errorf("error opening %s for reading: %v", filename, err)
+		return nil, nil, fmt.Errorf("error opening %s for reading: %v", filename, err)
 	}
 	defer r.Close()
 	g, err := gpx.Read(r)
 	if err != nil {
-		return nil, fmt.Errorf("error reading GPS track %s: %v", filename, err)
+		return nil, nil, fmt.Errorf("error reading GPS track %s: %v", filename, err)
 	}
 	trans, err := osgb.NewOSTN15Transformer()
 	if err != nil {
-		return nil, fmt.Errorf("error constructing coordinate transformer: %v", err)
+		return nil, nil, fmt.Errorf("error constructing coordinate transformer: %v", err)
 	}
 	distance := 0.0
+	segment := 0
 	var prevPoint *osgb.OSGB36Coordinate
 	var points []RoutePoint
 	for _, trk := range g.Trk {
@@ -113,23 +190,30 @@ func readGPXTrack(filename string) ([]RoutePoint, error) {
 				gpsCoord := osgb.NewETRS89Coord(trkPt.Lon, trkPt.Lat, trkPt.Ele)
 				p, err := trans.ToNationalGrid(gpsCoord)
 				if err != nil {
-					return nil, fmt.Errorf("error converting coordinates to National Grid: %v", err)
+					return nil, nil, fmt.Errorf("error converting coordinates to National Grid: %v", err)
 				}
 				if prevPoint != nil {
 					distance += euclideanDistance(prevPoint, p)
 				}
 				points = append(points, RoutePoint{
+					WptType:    trkPt,
+					Segment:    segment,
 					Coordinate: p,
 					Distance:   distance,
 				})
 				prevPoint = p
 			}
+			segment++
 		}
 	}
-	return points, nil
+	return g, points, nil
 }
 
+// RoutePoint is a track point with its National Grid coordinates and distance (in metres)
+// from the start of the route. Segment counts track segments across all tracks in the file.
 type RoutePoint struct {
+	*gpx.WptType
+	Segment    int
 	Coordinate *osgb.OSGB36Coordinate
 	Distance   float64
 }
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/twpayne/go-gpx"
+)
+
+func writeReport(w io.Writer, format string, anomalies []Anomaly) error {
+	switch format {
+	case "text":
+		return writeText(w, anomalies)
+	case "json":
+		return writeJSON(w, anomalies)
+	case "gpx":
+		return writeGPX(w, anomalies)
+	default:
+		return fmt.Errorf("invalid format: %s", format)
+	}
+}
+
+func writeText(w io.Writer, anomalies []Anomaly) error {
+	for _, a := range anomalies {
+		var err error
+		if r := a.Repeat; r != nil && a.Type == "repeat" {
+			if r.Length == 0 {
+				_, err = fmt.Fprintf(w, "Point (%0.f, %0.f) revisited at %0.2f km and %0.2f km\n",
+					r.Start.Easting, r.Start.Northing, r.Start.Distance, r.RevisitStart.Distance)
+			} else {
+				_, err = fmt.Fprintf(w, "Section (%0.f, %0.f) to (%0.f, %0.f) at %0.2f-%0.2f km revisited at %0.2f-%0.2f km (%0.2f km)\n",
+					r.Start.Easting, r.Start.Northing, r.End.Easting, r.End.Northing,
+					r.Start.Distance, r.End.Distance, r.RevisitStart.Distance, r.RevisitEnd.Distance, r.Length)
+			}
+		} else {
+			_, err = fmt.Fprintf(w, "%s: %s at (%0.f, %0.f) %0.2f km: %s\n",
+				a.Severity, a.Type, a.Location.Easting, a.Location.Northing, a.Location.Distance, a.Description)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeJSON(w io.Writer, anomalies []Anomaly) error {
+	if anomalies == nil {
+		anomalies = []Anomaly{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	return enc.Encode(anomalies)
+}
+
+// writeGPX writes a waypoint at the location of each anomaly, and at the end of each
+// repeated section.
+func writeGPX(w io.Writer, anomalies []Anomaly) error {
+	g := gpx.GPX{Version: "1.1", Creator: "gpx-anomalies"}
+	for n, a := range anomalies {
+		g.Wpt = append(g.Wpt, &gpx.WptType{
+			Lat:  a.Location.Lat,
+			Lon:  a.Location.Lon,
+			Name: fmt.Sprintf("%d %s", n+1, a.Type),
+			Desc: a.Description,
+			Type: string(a.Severity),
+		})
+		if r := a.Repeat; r != nil && r.Length > 0 {
+			g.Wpt = append(g.Wpt, &gpx.WptType{
+				Lat:  r.End.Lat,
+				Lon:  r.End.Lon,
+				Name: fmt.Sprintf("%d %s end", n+1, a.Type),
+				Desc: a.Description,
+				Type: string(a.Severity),
+			})
+		}
+	}
+	return writeGPXFile(w, &g)
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/twpayne/go-gpx"
+	"github.com/urfave/cli/v2"
+
+	"github.com/ray1729/gpx-utils/pkg/placenames"
+	"github.com/ray1729/gpx-utils/pkg/track"
+)
+
+func main() {
+	log.SetFlags(0)
+	outputFlag := &cli.StringFlag{
+		Name:    "output",
+		Aliases: []string{"o"},
+		Usage:   "Write the result to this file instead of STDOUT",
+	}
+	app := &cli.App{
+		Name:  "gpx-edit",
+		Usage: "Concatenate, split, trim and reverse GPX tracks",
+		Commands: []*cli.Command{
+			{
+				Name:      "concat",
+				Usage:     "Join several GPX files into a single track",
+				ArgsUsage: "GPX_FILE...",
+				Flags: []cli.Flag{
+					outputFlag,
+					&cli.StringFlag{
+						Name:  "name",
+						Usage: "Name of the combined track",
+					},
+				},
+				Action: concat,
+			},
+			{
+				Name:      "split",
+				Usage:     "Split a track in two at a named place or distance",
+				ArgsUsage: "GPX_FILE",
+				Flags: []cli.Flag{
+					&cli.Float64Flag{
+						Name:  "at-distance",
+						Usage: "Split the track this many kilometres from the start",
+					},
+					&cli.StringFlag{
+						Name:  "at-place",
+						Usage: "Split the track where it first passes through this place",
+					},
+					&cli.StringFlag{
+						Name:  "prefix",
+						Usage: "Write the two halves to PREFIX-1.gpx and PREFIX-2.gpx (default: the input file name)",
+					},
+				},
+				Action: split,
+			},
+			{
+				Name:      "trim",
+				Usage:     "Remove a distance or time from the start and end of a track",
+				ArgsUsage: "GPX_FILE",
+				Flags: []cli.Flag{
+					outputFlag,
+					&cli.Float64Flag{
+						Name:  "start",
+						Usage: "Remove this many kilometres from the start of the track",
+					},
+					&cli.Float64Flag{
+						Name:  "end",
+						Usage: "Remove this many kilometres from the end of the track",
+					},
+					&cli.DurationFlag{
+						Name:  "start-time",
+						Usage: "Remove points recorded in this period at the start of the track",
+					},
+					&cli.DurationFlag{
+						Name:  "end-time",
+						Usage: "Remove points recorded in this period at the end of the track",
+					},
+				},
+				Action: trim,
+			},
+			{
+				Name:      "reverse",
+				Usage:     "Reverse the direction of a route",
+				ArgsUsage: "GPX_FILE",
+				Flags: []cli.Flag{
+					outputFlag,
+					&cli.StringFlag{
+						Name:  "name",
+						Usage: "Name of the reversed track (default: the original name followed by \"(reversed)\")",
+					},
+					&cli.StringFlag{
+						Name:  "summary",
+						Usage: "Write a JSON summary of the reversed route to this file",
+					},
+				},
+				Action: reverse,
+			},
+		},
+	}
+	if err := app.Run(os.Args); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func concat(c *cli.Context) error {
+	if c.NArg() < 2 {
+		return fmt.Errorf("at least two GPX files are required")
+	}
+	var tracks [][]track.Point
+	var waypoints []*gpx.WptType
+	var first *gpx.GPX
+	for _, filename := range c.Args().Slice() {
+		g, points, err := track.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		if first == nil {
+			first = g
+		}
+		tracks = append(tracks, points)
+		waypoints = append(waypoints, g.Wpt...)
+	}
+	name := c.String("name")
+	if name == "" {
+		name = trackName(first)
+	}
+	metadata := first.Metadata
+	if metadata != nil {
+		metadata.Name = name
+	}
+	combined := track.ToGPX(name, metadata, track.Concat(tracks...))
+	combined.Wpt = waypoints
+	return writeOutput(c.String("output"), combined)
+}
+
+func split(c *cli.Context) error {
+	filename, err := singleArg(c)
+	if err != nil {
+		return err
+	}
+	g, points, err := track.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var first, second []track.Point
+	switch {
+	case c.IsSet("at-distance") && !c.IsSet("at-place"):
+		first, second, err = track.Split(points, c.Float64("at-distance")*1000.0)
+		if err != nil {
+			return err
+		}
+	case c.IsSet("at-place") && !c.IsSet("at-distance"):
+		place := c.String("at-place")
+		d, err := placeDistance(g, place)
+		if err != nil {
+			return err
+		}
+		first, second, err = track.Split(points, d)
+		if err != nil {
+			return fmt.Errorf("cannot split at %s, which is at the start or end of the track: %v", place, err)
+		}
+	default:
+		return fmt.Errorf("exactly one of --at-distance or --at-place is required")
+	}
+	prefix := c.String("prefix")
+	if prefix == "" {
+		prefix = strings.TrimSuffix(filename, filepath.Ext(filename))
+	}
+	name := trackName(g)
+	for i, points := range [][]track.Point{first, second} {
+		outfile := fmt.Sprintf("%s-%d.gpx", prefix, i+1)
+		partName := fmt.Sprintf("%s (%d of 2)", name, i+1)
+		if err := writeOutput(outfile, track.ToGPX(partName, nil, points)); err != nil {
+			return err
+		}
+		log.Printf("Wrote %0.2f km to %s", points[len(points)-1].Distance/1000.0, outfile)
+	}
+	return nil
+}
+
+// placeDistance returns the distance (in metres) along the track at which it first passes
+// through the named place.
+func placeDistance(g *gpx.GPX, place string) (float64, error) {
+	gs, err := placenames.NewGPXSummarizer()
+	if err != nil {
+		return 0, err
+	}
+	summary, err := summarize(gs, g)
+	if err != nil {
+		return 0, err
+	}
+	for _, poi := range summary.PointsOfInterest {
+		if strings.EqualFold(poi.Name, place) {
+			return poi.Distance * 1000.0, nil
+		}
+	}
+	return 0, fmt.Errorf("track does not pass through %s", place)
+}
+
+func trim(c *cli.Context) error {
+	filename, err := singleArg(c)
+	if err != nil {
+		return err
+	}
+	g, points, err := track.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if c.IsSet("start-time") || c.IsSet("end-time") {
+		if len(points) == 0 || points[0].Time.IsZero() {
+			return fmt.Errorf("%s has no timestamps", filename)
+		}
+		points = track.TrimTime(points, c.Duration("start-time"), c.Duration("end-time"))
+	}
+	points = track.Trim(points, c.Float64("start")*1000.0, c.Float64("end")*1000.0)
+	if len(points) < 2 {
+		return fmt.Errorf("nothing left of %s after trimming", filename)
+	}
+	return writeOutput(c.String("output"), track.ToGPX(trackName(g), g.Metadata, points))
+}
+
+func reverse(c *cli.Context) error {
+	filename, err := singleArg(c)
+	if err != nil {
+		return err
+	}
+	g, points, err := track.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	name := c.String("name")
+	if name == "" {
+		name = strings.TrimSpace(trackName(g) + " (reversed)")
+	}
+	points = track.Reverse(points)
+	// Keep the rest of the original metadata, but give it the new name and the first timestamp
+	// of the reversed track, or the time it was written if the track has no timestamps.
+	var metadata gpx.MetadataType
+	if g.Metadata != nil {
+		metadata = *g.Metadata
+	}
+	metadata.Name = name
+	metadata.Time = time.Now().UTC().Truncate(time.Second)
+	for _, p := range points {
+		if !p.Time.IsZero() {
+			metadata.Time = p.Time
+			break
+		}
+	}
+	reversed := track.ToGPX(name, &metadata, points)
+	reversed.Wpt = g.Wpt
+	if err := writeOutput(c.String("output"), reversed); err != nil {
+		return err
+	}
+	if summaryFile := c.String("summary"); summaryFile != "" {
+		gs, err := placenames.NewGPXSummarizer()
+		if err != nil {
+			return err
+		}
+		summary, err := summarize(gs, reversed)
+		if err != nil {
+			return err
+		}
+		if err := writeSummary(summaryFile, summary); err != nil {
+			return err
+		}
+		log.Printf("Reversed route runs from %s to %s heading %s", summary.Start, summary.Finish, summary.Direction)
+	}
+	return nil
+}
+
+// writeSummary writes s as JSON in the format used by analyze-gpx.
+func writeSummary(filename string, s *placenames.TrackSummary) error {
+	data, err := json.MarshalIndent(s, "", "    ")
+	if err != nil {
+		return fmt.Errorf("error marshalling summary: %v", err)
+	}
+	if err := ioutil.WriteFile(filename, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing %s: %v", filename, err)
+	}
+	return nil
+}
+
+func summarize(gs *placenames.GPXSummarizer, g *gpx.GPX) (*placenames.TrackSummary, error) {
+	var buf bytes.Buffer
+	if err := g.Write(&buf); err != nil {
+		return nil, err
+	}
+	return gs.SummarizeTrack(&buf, nil)
+}
+
+func singleArg(c *cli.Context) (string, error) {
+	if c.NArg() != 1 {
+		return "", fmt.Errorf("expected a single GPX file")
+	}
+	return c.Args().First(), nil
+}
+
+func trackName(g *gpx.GPX) string {
+	if g.Metadata != nil && g.Metadata.Name != "" {
+		return g.Metadata.Name
+	}
+	if len(g.Trk) > 0 {
+		return g.Trk[0].Name
+	}
+	return ""
+}
+
+// writeOutput writes g to STDOUT, or to the named file if filename is not empty.
+func writeOutput(filename string, g *gpx.GPX) error {
+	if filename == "" {
+		return track.WriteGPX(os.Stdout, g)
+	}
+	wc, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("error creating output file %s: %v", filename, err)
+	}
+	if err := track.WriteGPX(wc, g); err != nil {
+		wc.Close()
+		return fmt.Errorf("error writing %s: %v", filename, err)
+	}
+	if err := wc.Close(); err != nil {
+		return fmt.Errorf("error closing file %s: %v", filename, err)
+	}
+	return nil
+}
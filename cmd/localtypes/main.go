@@ -12,10 +12,10 @@ import (
 func main() {
 	log.SetFlags(0)
 	if len(os.Args) != 2 {
-		log.Fatal("Usage: %s OPNAME_CSV_ZIP", os.Args[0])
+		log.Fatalf("Usage: %s OPNAME_CSV_ZIP", os.Args[0])
 	}
 	var records []*openname.Record
-	openname.ProcessFile(
+	skipped, err := openname.ProcessFile(
 		os.Args[1],
 		func(r *openname.Record) error {
 			records = append(records, r)
@@ -24,6 +24,12 @@ func main() {
 		openname.FilterType("populatedPlace"),
 		openname.FilterWithinRadius(544945, 258410, 20000),
 	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if skipped > 0 {
+		log.Printf("Skipped %d malformed records", skipped)
+	}
 	sort.Slice(records, func(i, j int) bool {
 		return records[i].Name < records[j].Name
 	})
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// gridSquare returns the Ordnance Survey grid reference of the square of the given size
+// (100000, 10000 or 1000 metres) containing the point, e.g. TL45 for a 10km square.
+func gridSquare(easting, northing, size float64) string {
+	e100k := int(math.Floor(easting / 100000))
+	n100k := int(math.Floor(northing / 100000))
+	if e100k < 0 || e100k > 6 || n100k < 0 || n100k > 12 {
+		return ""
+	}
+	l1 := (19 - n100k) - (19-n100k)%5 + (e100k+10)/5
+	l2 := (19-n100k)*5%25 + e100k%5
+	// The letter I is not used.
+	if l1 > 7 {
+		l1++
+	}
+	if l2 > 7 {
+		l2++
+	}
+	letters := string(rune('A'+l1)) + string(rune('A'+l2))
+	digits := 0
+	for s := size; s < 100000; s *= 10 {
+		digits++
+	}
+	if digits == 0 {
+		return letters
+	}
+	div := math.Pow(10, float64(5-digits))
+	e := int(math.Mod(easting, 100000) / div)
+	n := int(math.Mod(northing, 100000) / div)
+	return fmt.Sprintf("%s%0*d%0*d", letters, digits, e, digits, n)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ray1729/gpx-utils/pkg/placenames"
+)
+
+func main() {
+	log.SetFlags(0)
+	home := flag.String("home", "", "Home location: a place name or EASTING,NORTHING")
+	radius := flag.Float64("radius", 30, "Report places within this distance (km) of home that have never been visited")
+	minSettlement := flag.String("ms", "Village", "Exclude populated places smaller than this (City, Town, Village, Hamlet, Other Settlement)")
+	gridSize := flag.Float64("grid", 10, "Size (km) of the National Grid squares to count: 1, 10 or 100. Only squares containing the centre of a place visited are counted, as summaries do not record the track itself")
+	format := flag.String("format", "text", "Output format (text or json)")
+	flag.Parse()
+	if flag.NArg() < 1 {
+		log.Fatalf("Usage: %s [-home PLACE] [-radius KM] [-ms SETTLEMENT] [-grid KM] SUMMARY_FILE_OR_DIRECTORY...", os.Args[0])
+	}
+	minRank, ok := placenames.SettlementRank(*minSettlement)
+	if !ok {
+		log.Fatalf("Invalid settlement type: %s", *minSettlement)
+	}
+	if *gridSize != 1 && *gridSize != 10 && *gridSize != 100 {
+		log.Fatalf("Invalid grid size: %g", *gridSize)
+	}
+	boundaries, err := placenames.Boundaries()
+	if err != nil {
+		log.Fatal(err)
+	}
+	places := newPlaceIndex(boundaries, minRank)
+	var summaries []*placenames.TrackSummary
+	for _, arg := range flag.Args() {
+		xs, err := readSummaries(arg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		summaries = append(summaries, xs...)
+	}
+	stats := collectStats(summaries, places, *gridSize*1000)
+	if *home != "" {
+		e, n, err := places.locate(*home)
+		if err != nil {
+			log.Fatal(err)
+		}
+		stats.NeverVisited = places.unvisited(stats.visited, e, n, *radius*1000)
+	}
+	switch *format {
+	case "text":
+		writeText(stats)
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "    ")
+		if err := enc.Encode(stats); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("Invalid format: %s", *format)
+	}
+}
+
+func readSummaries(root string) ([]*placenames.TrackSummary, error) {
+	var summaries []*placenames.TrackSummary
+	err := filepath.Walk(root, func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(filename) != ".json" {
+			return nil
+		}
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		var ts placenames.TrackSummary
+		if err := json.Unmarshal(data, &ts); err != nil {
+			return fmt.Errorf("error parsing %s: %v", filename, err)
+		}
+		summaries = append(summaries, &ts)
+		return nil
+	})
+	return summaries, err
+}
+
+// placeIndex holds the populated places of at least the minimum rank, indexed by name.
+type placeIndex struct {
+	minRank  int
+	byName   map[string][]*placenames.NamedBoundary
+	byCounty map[string]int
+	all      []*placenames.NamedBoundary
+}
+
+func newPlaceIndex(boundaries []*placenames.NamedBoundary, minRank int) *placeIndex {
+	idx := &placeIndex{
+		minRank:  minRank,
+		byName:   make(map[string][]*placenames.NamedBoundary),
+		byCounty: make(map[string]int),
+	}
+	for _, b := range boundaries {
+		if populatedPlaceRank(b) < minRank {
+			continue
+		}
+		key := strings.ToLower(b.Name)
+		idx.byName[key] = append(idx.byName[key], b)
+		idx.byCounty[b.County]++
+		idx.all = append(idx.all, b)
+	}
+	return idx
+}
+
+// resolve finds the place matching a point of interest, or nil if the place cannot be
+// identified unambiguously.
+func (idx *placeIndex) resolve(poi placenames.POI) *placenames.NamedBoundary {
+	var match *placenames.NamedBoundary
+	for _, b := range idx.byName[strings.ToLower(poi.Name)] {
+		if b.Type != poi.Type || (poi.County != "" && b.County != poi.County) {
+			continue
+		}
+		if poi.Easting != 0 && !b.Contains([]float64{poi.Easting, poi.Northing}) {
+			continue
+		}
+		if match != nil {
+			return nil
+		}
+		match = b
+	}
+	return match
+}
+
+// locate returns the coordinates of home, given as EASTING,NORTHING or a place name.
+func (idx *placeIndex) locate(home string) (float64, float64, error) {
+	if xs := strings.Split(home, ","); len(xs) == 2 {
+		e, err1 := strconv.ParseFloat(strings.TrimSpace(xs[0]), 64)
+		n, err2 := strconv.ParseFloat(strings.TrimSpace(xs[1]), 64)
+		if err1 == nil && err2 == nil {
+			return e, n, nil
+		}
+	}
+	candidates := idx.byName[strings.ToLower(home)]
+	if len(candidates) == 0 {
+		return 0, 0, fmt.Errorf("unknown place: %s", home)
+	}
+	// Prefer the most significant place of that name.
+	best := candidates[0]
+	for _, b := range candidates[1:] {
+		if populatedPlaceRank(b) > populatedPlaceRank(best) {
+			best = b
+		}
+	}
+	if len(candidates) > 1 {
+		log.Printf("%s is ambiguous, using the %s in %s", home, strings.ToLower(best.Type), best.County)
+	}
+	e, n := centre(best)
+	return e, n, nil
+}
+
+func (idx *placeIndex) unvisited(visited map[*placenames.NamedBoundary]bool, e, n, radius float64) []Place {
+	var result []Place
+	for _, b := range idx.all {
+		if visited[b] {
+			continue
+		}
+		x, y := centre(b)
+		d := math.Hypot(x-e, y-n)
+		if d <= radius {
+			result = append(result, Place{Name: b.Name, Type: b.Type, County: b.County, Distance: d / 1000.0})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Distance < result[j].Distance })
+	return result
+}
+
+func populatedPlaceRank(b *placenames.NamedBoundary) int {
+	rank, _ := placenames.SettlementRank(b.Type)
+	return rank
+}
+
+func centre(b *placenames.NamedBoundary) (float64, float64) {
+	return (b.Xmin + b.Xmax) / 2, (b.Ymin + b.Ymax) / 2
+}
+
+type Place struct {
+	Name     string
+	Type     string
+	County   string
+	Visits   int     `json:",omitempty"`
+	Distance float64 `json:",omitempty"` // km from home
+}
+
+type CountyCoverage struct {
+	County  string
+	Visited int
+	Total   int
+	Percent float64
+}
+
+type GridSquare struct {
+	Square string
+	Visits int
+}
+
+type Stats struct {
+	Rides        int
+	Places       []Place
+	Counties     []CountyCoverage
+	GridSquares  []GridSquare // squares containing the places visited, not every square crossed
+	NeverVisited []Place      `json:",omitempty"`
+	Unresolved   int          // points of interest that could not be matched to a place
+
+	visited map[*placenames.NamedBoundary]bool
+}
+
+// collectStats counts the rides through each place and grid square. A place visited more
+// than once on the same ride is counted once. A ride is counted in the squares containing the
+// centres of the places it visits, which may miss squares the track crosses between places.
+func collectStats(summaries []*placenames.TrackSummary, idx *placeIndex, gridSize float64) *Stats {
+	stats := &Stats{Rides: len(summaries), visited: make(map[*placenames.NamedBoundary]bool)}
+	placeVisits := make(map[*placenames.NamedBoundary]int)
+	squareVisits := make(map[string]int)
+	for _, s := range summaries {
+		seen := make(map[*placenames.NamedBoundary]bool)
+		squares := make(map[string]bool)
+		for _, poi := range s.PointsOfInterest {
+			if rank, _ := placenames.SettlementRank(poi.Type); rank < idx.minRank {
+				continue
+			}
+			b := idx.resolve(poi)
+			if b == nil {
+				stats.Unresolved++
+				continue
+			}
+			seen[b] = true
+			// Places outside the National Grid have no square
+			e, n := centre(b)
+			if sq := gridSquare(e, n, gridSize); sq != "" {
+				squares[sq] = true
+			}
+		}
+		for b := range seen {
+			placeVisits[b]++
+			stats.visited[b] = true
+		}
+		for sq := range squares {
+			squareVisits[sq]++
+		}
+	}
+	countyVisited := make(map[string]int)
+	for b, n := range placeVisits {
+		stats.Places = append(stats.Places, Place{Name: b.Name, Type: b.Type, County: b.County, Visits: n})
+		countyVisited[b.County]++
+	}
+	sort.Slice(stats.Places, func(i, j int) bool {
+		if stats.Places[i].Visits != stats.Places[j].Visits {
+			return stats.Places[i].Visits > stats.Places[j].Visits
+		}
+		return stats.Places[i].Name < stats.Places[j].Name
+	})
+	for county, n := range countyVisited {
+		total := idx.byCounty[county]
+		stats.Counties = append(stats.Counties, CountyCoverage{
+			County:  county,
+			Visited: n,
+			Total:   total,
+			Percent: 100 * float64(n) / float64(total),
+		})
+	}
+	sort.Slice(stats.Counties, func(i, j int) bool { return stats.Counties[i].Percent > stats.Counties[j].Percent })
+	for sq, n := range squareVisits {
+		stats.GridSquares = append(stats.GridSquares, GridSquare{Square: sq, Visits: n})
+	}
+	sort.Slice(stats.GridSquares, func(i, j int) bool { return stats.GridSquares[i].Square < stats.GridSquares[j].Square })
+	return stats
+}
+
+func writeText(stats *Stats) {
+	fmt.Printf("Rides: %d\n\nPlaces visited:\n", stats.Rides)
+	for _, p := range stats.Places {
+		fmt.Printf("  %4d  %s (%s, %s)\n", p.Visits, p.Name, p.Type, p.County)
+	}
+	fmt.Printf("\nCounty coverage:\n")
+	for _, c := range stats.Counties {
+		fmt.Printf("  %5.1f%%  %s (%d of %d places)\n", c.Percent, c.County, c.Visited, c.Total)
+	}
+	fmt.Printf("\nGrid squares (containing the places visited):\n")
+	for _, sq := range stats.GridSquares {
+		fmt.Printf("  %4d  %s\n", sq.Visits, sq.Square)
+	}
+	if stats.NeverVisited != nil {
+		fmt.Printf("\nNever visited:\n")
+		for _, p := range stats.NeverVisited {
+			fmt.Printf("  %5.1f km  %s (%s, %s)\n", p.Distance, p.Name, p.Type, p.County)
+		}
+	}
+	if stats.Unresolved > 0 {
+		fmt.Printf("\n%d points of interest could not be matched to a unique place\n", stats.Unresolved)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/ray1729/gpx-utils/pkg/library"
+	"github.com/ray1729/gpx-utils/pkg/placenames"
+)
+
+func main() {
+	log.SetFlags(0)
+	app := &cli.App{
+		Name:  "ride-library",
+		Usage: "Index ride summaries in a local database and query them",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "db",
+				Usage:   "Library database file",
+				EnvVars: []string{"RIDE_LIBRARY"},
+				Value:   "rides.db",
+			},
+		},
+		Commands: []*cli.Command{
+			{
+				Name:      "index",
+				Usage:     "Add the JSON summaries written by analyze-gpx to the library",
+				ArgsUsage: "FILE_OR_DIRECTORY...",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "force",
+						Usage: "Re-index summaries that have not changed since they were last indexed",
+					},
+				},
+				Action: index,
+			},
+			{
+				Name:  "query",
+				Usage: "List rides matching the given criteria",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "start", Usage: "Rides starting at this place"},
+					&cli.StringFlag{Name: "finish", Usage: "Rides finishing at this place"},
+					&cli.StringSliceFlag{Name: "through", Usage: "Rides passing through this place (may be repeated)"},
+					&cli.StringFlag{Name: "county", Usage: "Rides passing through this county"},
+					&cli.StringFlag{Name: "stop", Usage: "Rides passing a refreshment stop whose name contains this"},
+					&cli.Float64Flag{Name: "min-distance", Usage: "Minimum distance (km)"},
+					&cli.Float64Flag{Name: "max-distance", Usage: "Maximum distance (km)"},
+					&cli.Float64Flag{Name: "min-ascent", Usage: "Minimum ascent (m)"},
+					&cli.Float64Flag{Name: "max-ascent", Usage: "Maximum ascent (m)"},
+					&cli.IntFlag{Name: "year", Usage: "Rides in this year"},
+					&cli.TimestampFlag{Name: "from", Usage: "Rides on or after this date (YYYY-MM-DD)", Layout: "2006-01-02"},
+					&cli.TimestampFlag{Name: "to", Usage: "Rides before this date (YYYY-MM-DD)", Layout: "2006-01-02"},
+					&cli.StringFlag{Name: "format", Usage: "Output format (csv or json)", Value: "csv"},
+				},
+				Action: query,
+			},
+			{
+				Name:  "search",
+				Usage: "Find routes passing through places in order, ranked by how closely they match",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "start", Usage: "Routes starting at this place"},
+					&cli.StringSliceFlag{Name: "via", Usage: "Routes passing through this place, in order (may be repeated)"},
+					&cli.StringFlag{Name: "finish", Usage: "Routes finishing at this place"},
+					&cli.Float64Flag{Name: "min-distance", Usage: "Minimum distance (km)"},
+					&cli.Float64Flag{Name: "max-distance", Usage: "Maximum distance (km)"},
+					&cli.Float64Flag{Name: "min-ascent", Usage: "Minimum ascent (m)"},
+					&cli.Float64Flag{Name: "max-ascent", Usage: "Maximum ascent (m)"},
+					&cli.IntFlag{Name: "limit", Usage: "Maximum number of results", Value: 20},
+				},
+				Action: search,
+			},
+		},
+	}
+	if err := app.Run(os.Args); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func index(c *cli.Context) error {
+	lib, err := library.Open(c.String("db"))
+	if err != nil {
+		return err
+	}
+	defer lib.Close()
+	var added, skipped, rejected int
+	for _, root := range c.Args().Slice() {
+		err := filepath.Walk(root, func(filename string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || filepath.Ext(filename) != ".json" {
+				return nil
+			}
+			source, err := filepath.Abs(filename)
+			if err != nil {
+				return fmt.Errorf("error finding absolute path of %s: %v", filename, err)
+			}
+			id := rideID(source)
+			if !c.Bool("force") {
+				if r, err := lib.Get(id); err == nil && r.Source == source && !info.ModTime().After(r.Modified) {
+					skipped++
+					return nil
+				}
+			}
+			summary, err := readTrackSummary(filename)
+			if err != nil {
+				log.Printf("Skipping %s: %v", filename, err)
+				rejected++
+				return nil
+			}
+			r := library.NewRide(id, library.RideDate(filename, summary.Time, info.ModTime()), summary)
+			r.Source = source
+			r.Modified = info.ModTime()
+			if err := lib.Put(r); err != nil {
+				return fmt.Errorf("error indexing %s: %v", filename, err)
+			}
+			added++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("Indexed %d rides (%d unchanged, %d not ride summaries)", added, skipped, rejected)
+	return nil
+}
+
+func query(c *cli.Context) error {
+	lib, err := library.OpenReadOnly(c.String("db"))
+	if err != nil {
+		return err
+	}
+	defer lib.Close()
+	q := library.Query{
+		Start:       c.String("start"),
+		Finish:      c.String("finish"),
+		Through:     c.StringSlice("through"),
+		County:      c.String("county"),
+		Stop:        c.String("stop"),
+		MinDistance: c.Float64("min-distance"),
+		MaxDistance: c.Float64("max-distance"),
+		MinAscent:   c.Float64("min-ascent"),
+		MaxAscent:   c.Float64("max-ascent"),
+	}
+	if t := c.Timestamp("from"); t != nil {
+		q.From = *t
+	}
+	if t := c.Timestamp("to"); t != nil {
+		q.To = *t
+	}
+	if y := c.Int("year"); y != 0 {
+		q.From = time.Date(y, 1, 1, 0, 0, 0, 0, time.UTC)
+		q.To = time.Date(y+1, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	rides, err := lib.Query(q)
+	if err != nil {
+		return err
+	}
+	switch c.String("format") {
+	case "csv":
+		return writeCSV(rides)
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "    ")
+		return enc.Encode(rides)
+	default:
+		return fmt.Errorf("invalid format: %s", c.String("format"))
+	}
+}
+
+func search(c *cli.Context) error {
+	lib, err := library.OpenReadOnly(c.String("db"))
+	if err != nil {
+		return err
+	}
+	defer lib.Close()
+	results, err := lib.Search(library.RouteQuery{
+		Start:       c.String("start"),
+		Via:         c.StringSlice("via"),
+		Finish:      c.String("finish"),
+		MinDistance: c.Float64("min-distance"),
+		MaxDistance: c.Float64("max-distance"),
+		MinAscent:   c.Float64("min-ascent"),
+		MaxAscent:   c.Float64("max-ascent"),
+	}, c.Int("limit"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{"Score", "Date", "Name", "Start", "Finish", "Distance", "Ascent", "Source"})
+	for _, res := range results {
+		r := res.Ride
+		w.Write([]string{
+			strconv.FormatFloat(res.Score, 'f', 2, 64),
+			r.Date.Format("2006-01-02"),
+			r.Name,
+			r.Start,
+			r.Finish,
+			strconv.FormatFloat(r.Distance, 'f', 1, 32),
+			strconv.FormatFloat(r.Ascent, 'f', 0, 32),
+			r.Source,
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func writeCSV(rides []*library.Ride) error {
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{"Date", "Name", "Start", "Finish", "Distance", "Ascent", "Source"})
+	for _, r := range rides {
+		w.Write([]string{
+			r.Date.Format("2006-01-02"),
+			r.Name,
+			r.Start,
+			r.Finish,
+			strconv.FormatFloat(r.Distance, 'f', 1, 32),
+			strconv.FormatFloat(r.Ascent, 'f', 0, 32),
+			r.Source,
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// rideID identifies a ride by the absolute path of its summary, so that summaries with the same
+// name in different directories are kept apart however the directory is named on the command line.
+func rideID(source string) string {
+	return strings.TrimSuffix(filepath.ToSlash(source), ".json")
+}
+
+// readTrackSummary reads a summary written by analyze-gpx, rejecting other JSON files.
+func readTrackSummary(path string) (*placenames.TrackSummary, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ts placenames.TrackSummary
+	if err := json.Unmarshal(data, &ts); err != nil {
+		return nil, fmt.Errorf("not a track summary: %v", err)
+	}
+	if ts.Start == "" || ts.Distance <= 0 {
+		return nil, errors.New("not a track summary: no track")
+	}
+	return &ts, nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/fofanov/go-osgb"
+	"github.com/twpayne/go-gpx"
+
+	"github.com/ray1729/gpx-utils/pkg/track"
+)
+
+func main() {
+	log.SetFlags(0)
+	threshold := flag.Float64("threshold", 0.25, "Routes within this distance (km) of each other are considered variants")
+	metric := flag.String("metric", "hausdorff", "Similarity measure: hausdorff (ignores direction) or frechet")
+	interval := flag.Float64("resample", 200, "Resample routes to points this distance (m) apart before comparing")
+	maxLengthRatio := flag.Float64("max-length-ratio", 1.2, "Do not compare routes whose lengths differ by more than this factor")
+	format := flag.String("format", "text", "Output format (text or json)")
+	flag.Parse()
+	if flag.NArg() < 1 {
+		log.Fatalf("Usage: %s [-threshold KM] [-metric hausdorff|frechet] GPX_FILE_OR_DIRECTORY...", os.Args[0])
+	}
+	var distance func(a, b *route) float64
+	switch *metric {
+	case "hausdorff":
+		distance = func(a, b *route) float64 { return track.Hausdorff(a.points, b.points) }
+	case "frechet":
+		distance = func(a, b *route) float64 { return track.Frechet(a.points, b.points) }
+	default:
+		log.Fatalf("Invalid metric: %s", *metric)
+	}
+	routes, err := readRoutes(flag.Args(), *interval)
+	if err != nil {
+		log.Fatal(err)
+	}
+	families := cluster(routes, *threshold*1000.0, *maxLengthRatio, *metric, distance)
+	switch *format {
+	case "text":
+		writeText(families)
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "    ")
+		if err := enc.Encode(families); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("Invalid format: %s", *format)
+	}
+}
+
+type route struct {
+	filename string
+	name     string
+	points   []track.Point
+	length   float64
+}
+
+func readRoutes(args []string, interval float64) ([]*route, error) {
+	trans, err := osgb.NewOSTN15Transformer()
+	if err != nil {
+		return nil, fmt.Errorf("error constructing coordinate transformer: %v", err)
+	}
+	var routes []*route
+	for _, root := range args {
+		err := filepath.Walk(root, func(filename string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || filepath.Ext(filename) != ".gpx" {
+				return nil
+			}
+			r, err := readRoute(filename, trans, interval)
+			if err != nil {
+				return err
+			}
+			if len(r.points) < 2 {
+				log.Printf("Skipping %s: no track points", filename)
+				return nil
+			}
+			routes = append(routes, r)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return routes, nil
+}
+
+func readRoute(filename string, trans osgb.CoordinateTransformer, interval float64) (*route, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s for reading: %v", filename, err)
+	}
+	defer f.Close()
+	g, err := gpx.Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("error reading GPS track %s: %v", filename, err)
+	}
+	points, err := track.FromGPX(g, trans)
+	if err != nil {
+		return nil, fmt.Errorf("error reading GPS track %s: %v", filename, err)
+	}
+	r := &route{filename: filename, points: track.Resample(points, interval)}
+	if g.Metadata != nil {
+		r.name = g.Metadata.Name
+	}
+	if len(r.points) > 0 {
+		r.length = r.points[len(r.points)-1].Distance
+	}
+	return r, nil
+}
+
+type Variant struct {
+	Filename string
+	Name     string
+	Distance float64 // km from the canonical route
+}
+
+// Family is a group of similar routes. The canonical route is the member closest on
+// average to the others.
+type Family struct {
+	Canonical Variant
+	Variants  []Variant
+}
+
+// cluster groups routes into families by single linkage: two routes are in the same family
+// if they are linked by a chain of routes each within threshold metres of the next.
+func cluster(routes []*route, threshold, maxLengthRatio float64, metric string, distance func(a, b *route) float64) []Family {
+	parent := make([]int, len(routes))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for i := range routes {
+		for j := i + 1; j < len(routes); j++ {
+			if find(i) == find(j) || !similarEnough(routes[i], routes[j], threshold, maxLengthRatio) {
+				continue
+			}
+			var similar bool
+			if metric == "hausdorff" {
+				similar = track.HausdorffWithin(routes[i].points, routes[j].points, threshold)
+			} else {
+				similar = distance(routes[i], routes[j]) <= threshold
+			}
+			if similar {
+				parent[find(j)] = find(i)
+			}
+		}
+	}
+	members := make(map[int][]int)
+	for i := range routes {
+		root := find(i)
+		members[root] = append(members[root], i)
+	}
+	var families []Family
+	for _, xs := range members {
+		if len(xs) < 2 {
+			continue
+		}
+		families = append(families, newFamily(routes, xs, distance))
+	}
+	sort.Slice(families, func(i, j int) bool {
+		if len(families[i].Variants) != len(families[j].Variants) {
+			return len(families[i].Variants) > len(families[j].Variants)
+		}
+		return families[i].Canonical.Filename < families[j].Canonical.Filename
+	})
+	return families
+}
+
+// similarEnough rules out pairs of routes that cannot be within threshold of each other
+// because of their lengths or starting points.
+func similarEnough(a, b *route, threshold, maxLengthRatio float64) bool {
+	if math.Max(a.length, b.length) > maxLengthRatio*math.Min(a.length, b.length) {
+		return false
+	}
+	// A similar route must start or finish near where the other starts.
+	start := a.points[0]
+	return track.Distance(start, b.points[0]) <= threshold || track.Distance(start, b.points[len(b.points)-1]) <= threshold
+}
+
+func newFamily(routes []*route, xs []int, distance func(a, b *route) float64) Family {
+	n := len(xs)
+	d := make([][]float64, n)
+	for i := range d {
+		d[i] = make([]float64, n)
+	}
+	best, bestTotal := 0, math.Inf(1)
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			d[i][j] = distance(routes[xs[i]], routes[xs[j]])
+			d[j][i] = d[i][j]
+		}
+	}
+	for i := 0; i < n; i++ {
+		total := 0.0
+		for j := 0; j < n; j++ {
+			total += d[i][j]
+		}
+		if total < bestTotal {
+			best, bestTotal = i, total
+		}
+	}
+	canonical := routes[xs[best]]
+	f := Family{Canonical: Variant{Filename: canonical.filename, Name: canonical.name}}
+	for i, x := range xs {
+		if i == best {
+			continue
+		}
+		f.Variants = append(f.Variants, Variant{
+			Filename: routes[x].filename,
+			Name:     routes[x].name,
+			Distance: d[best][i] / 1000.0,
+		})
+	}
+	sort.Slice(f.Variants, func(i, j int) bool { return f.Variants[i].Distance < f.Variants[j].Distance })
+	return f
+}
+
+func writeText(families []Family) {
+	for i, f := range families {
+		fmt.Printf("Family %d: %s (%s)\n", i+1, f.Canonical.Filename, f.Canonical.Name)
+		for _, v := range f.Variants {
+			fmt.Printf("    %6.2f km  %s (%s)\n", v.Distance, v.Filename, v.Name)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+// Command rwgps-sync summarizes every route of a RideWithGPS user or club and stores the
+// summaries in a ride library. Only routes added or updated since the last sync are fetched.
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dhconnelly/rtreego"
+
+	"github.com/ray1729/gpx-utils/pkg/cafes"
+	"github.com/ray1729/gpx-utils/pkg/library"
+	"github.com/ray1729/gpx-utils/pkg/placenames"
+	"github.com/ray1729/gpx-utils/pkg/rwgps"
+)
+
+// Number of routes requested per page of the route list
+const pageSize = 100
+
+func main() {
+	log.SetFlags(0)
+	dbFile := flag.String("db", envString("RIDE_LIBRARY", "rides.db"), "Library database file")
+	userId := flag.Int("user", 0, "Sync the routes of this RideWithGPS user")
+	clubId := flag.Int("club", 0, "Sync the routes of this RideWithGPS club")
+	stopNames := flag.String("stops", "", "Source for refreshment stops")
+	rate := flag.Float64("rate", 1, "Maximum requests per second to RideWithGPS")
+	retries := flag.Int("retries", 3, "Number of times to retry a failed request")
+	gpxDir := flag.String("gpx-dir", "", "Also save the GPX of each route in this directory")
+	force := flag.Bool("force", false, "Summarize routes that have not changed since the last sync")
+	flag.Parse()
+	if (*userId == 0) == (*clubId == 0) || flag.NArg() != 0 {
+		log.Fatalf("Usage: %s [-db FILE] [-stops S] [-rate N] [-gpx-dir DIR] -user ID|-club ID", os.Args[0])
+	}
+	if *rate <= 0 {
+		log.Fatalf("Invalid rate %g: must be positive", *rate)
+	}
+	owner := rwgps.Owner{Kind: "users", ID: *userId}
+	if *clubId != 0 {
+		owner = rwgps.Owner{Kind: "clubs", ID: *clubId}
+	}
+	if *gpxDir != "" {
+		if err := os.MkdirAll(*gpxDir, 0755); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var stops *rtreego.Rtree
+	if *stopNames != "" {
+		var err error
+		stops, err = cafes.New().Get(*stopNames)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	gs, err := placenames.NewGPXSummarizer()
+	if err != nil {
+		log.Fatal(err)
+	}
+	lib, err := library.Open(*dbFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := &syncer{
+		client:  rwgps.NewClientFromEnv(),
+		limiter: time.NewTicker(time.Duration(float64(time.Second) / *rate)),
+		retries: *retries,
+		gs:      gs,
+		stops:   stops,
+		lib:     lib,
+		gpxDir:  *gpxDir,
+		force:   *force,
+	}
+	err = s.sync(context.Background(), owner)
+	s.limiter.Stop()
+	if cerr := lib.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+type syncer struct {
+	client  *rwgps.Client
+	limiter *time.Ticker
+	retries int
+	gs      *placenames.GPXSummarizer
+	stops   *rtreego.Rtree
+	lib     *library.Library
+	gpxDir  string
+	force   bool
+}
+
+// sync pages through the routes of owner, summarizing the new and updated ones.
+func (s *syncer) sync(ctx context.Context, owner rwgps.Owner) error {
+	var added, unchanged, failed int
+	for offset := 0; ; offset += pageSize {
+		var routes []rwgps.Route
+		var total int
+		err := s.retry(ctx, fmt.Sprintf("route list of %s", owner), func() error {
+			var err error
+			routes, total, err = s.client.ListRoutes(ctx, owner, offset, pageSize)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("error listing routes of %s: %v", owner, err)
+		}
+		for _, route := range routes {
+			id := rideId(route.ID)
+			if !s.force {
+				if r, err := s.lib.Get(id); err == nil && !route.UpdatedAt.After(r.Modified) {
+					unchanged++
+					continue
+				}
+			}
+			if err := s.syncRoute(ctx, route); err != nil {
+				log.Printf("Error syncing route %d: %v", route.ID, err)
+				failed++
+				continue
+			}
+			added++
+			log.Printf("[%d/%d] Summarized route %d %s", added+unchanged+failed, total, route.ID, route.Name)
+		}
+		if len(routes) == 0 || offset+len(routes) >= total {
+			break
+		}
+	}
+	log.Printf("Synced %d routes (%d unchanged, %d failed)", added, unchanged, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d routes failed", failed)
+	}
+	return nil
+}
+
+// syncRoute fetches and summarizes a route and stores it in the library.
+func (s *syncer) syncRoute(ctx context.Context, route rwgps.Route) error {
+	var data []byte
+	err := s.retry(ctx, fmt.Sprintf("route %d", route.ID), func() error {
+		var err error
+		data, err = s.client.FetchTrack(ctx, route.ID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if s.gpxDir != "" {
+		filename := filepath.Join(s.gpxDir, fmt.Sprintf("%d.gpx", route.ID))
+		if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+			return fmt.Errorf("error writing %s: %v", filename, err)
+		}
+	}
+	summary, err := s.gs.SummarizeTrackContext(ctx, bytes.NewReader(data), s.stops)
+	if err != nil {
+		return fmt.Errorf("error creating summary: %v", err)
+	}
+	r := library.NewRide(rideId(route.ID), route.CreatedAt, summary)
+	if route.Name != "" {
+		r.Name = route.Name
+	}
+	r.Link = fmt.Sprintf("%s/routes/%d", rwgps.DefaultBaseURL, route.ID)
+	r.Source = r.Link
+	r.Modified = route.UpdatedAt
+	if err := s.lib.Put(r); err != nil {
+		return fmt.Errorf("error storing summary: %v", err)
+	}
+	return nil
+}
+
+// retry calls f, waiting for the rate limiter before each attempt and retrying with
+// exponential backoff if it fails with a temporary error.
+func (s *syncer) retry(ctx context.Context, what string, f func() error) error {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-s.limiter.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		err := f()
+		if err == nil || attempt >= s.retries || !temporary(err) {
+			return err
+		}
+		log.Printf("Error fetching %s, retrying in %s: %v", what, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// temporary reports whether err may succeed on retry: a network error, or a rate limit or
+// server error response.
+func temporary(err error) bool {
+	var upstream *rwgps.UpstreamError
+	if !errors.As(err, &upstream) {
+		return false
+	}
+	return upstream.StatusCode == 0 ||
+		upstream.StatusCode == http.StatusTooManyRequests ||
+		upstream.StatusCode >= 500
+}
+
+func rideId(routeId int) string {
+	return fmt.Sprintf("rwgps-route-%d", routeId)
+}
+
+func envString(name string, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
@@ -13,7 +13,7 @@ import (
 func main() {
 	log.SetFlags(0)
 	if len(os.Args) != 3 {
-		log.Fatal("Usage: %s INFILE OUTFILE", os.Args[0])
+		log.Fatalf("Usage: %s INFILE OUTFILE", os.Args[0])
 	}
 	wc, err := os.OpenFile(os.Args[2], os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
 	if err != nil {
@@ -21,7 +21,7 @@ func main() {
 	}
 	defer wc.Close()
 	enc := gob.NewEncoder(wc)
-	err = openname.ProcessFile(
+	skipped, err := openname.ProcessFile(
 		os.Args[1],
 		func(r *openname.Record) error {
 			b := placenames.NamedBoundary{
@@ -43,11 +43,14 @@ func main() {
 		},
 		openname.FilterType("populatedPlace"),
 		openname.FilterLocalType("Suburban Area").Complement(),
-		openname.FilterAreaGt(0),
+		openname.FilterHasBounds(),
 	)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if skipped > 0 {
+		log.Printf("Skipped %d malformed records", skipped)
+	}
 }
 
 func coalesce(xs ...string) string {
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ray1729/gpx-utils/pkg/cafes"
+	"github.com/ray1729/gpx-utils/pkg/placenames"
+	"github.com/ray1729/gpx-utils/pkg/rwgps"
+)
+
+// config holds the server settings. They are read from the environment, then from the JSON
+// config file if one is given, then from the command line flags, each overriding the last.
+type config struct {
+	Listen            string   `json:"listen"`
+	TLSCert           string   `json:"tlsCert"`
+	TLSKey            string   `json:"tlsKey"`
+	ReadHeaderTimeout duration `json:"readHeaderTimeout"`
+	ReadTimeout       duration `json:"readTimeout"`
+	WriteTimeout      duration `json:"writeTimeout"`
+	IdleTimeout       duration `json:"idleTimeout"`
+	ShutdownTimeout   duration `json:"shutdownTimeout"`
+
+	CORSOrigins stringList `json:"corsOrigins"`
+	RateLimit   float64    `json:"rateLimit"`
+	RateBurst   int        `json:"rateBurst"`
+	TrustProxy  bool       `json:"trustProxy"`
+
+	Timeout      duration `json:"timeout"`
+	FetchTimeout duration `json:"fetchTimeout"`
+	StopsTimeout duration `json:"stopsTimeout"`
+	MaxSize      int64    `json:"maxSize"`
+	MaxPoints    int      `json:"maxPoints"`
+	CacheTTL     duration `json:"cacheTTL"`
+	CacheDir     string   `json:"cacheDir"`
+	RWGPSURL     string   `json:"rwgpsURL"`
+	Library      string   `json:"library"`
+
+	WidgetTemplates string `json:"widgetTemplates"`
+
+	WatchRoutes   stringList `json:"watchRoutes"`
+	WatchCallback string     `json:"watchCallback"`
+	WatchInterval duration   `json:"watchInterval"`
+	WatchSecret   string     `json:"watchSecret"`
+
+	StopSearchRectangle   float64 `json:"stopSearchRectangle"`
+	StopDuplicateDistance float64 `json:"stopDuplicateDistance"`
+	POIDuplicateDistance  float64 `json:"poiDuplicateDistance"`
+	POIMinimumDistance    float64 `json:"poiMinimumDistance"`
+	MinimumSettlement     string  `json:"minimumSettlement"`
+}
+
+// defaultConfig returns the built-in settings, overridden by any environment variables.
+func defaultConfig() (*config, error) {
+	defaults := placenames.DefaultGPXSummarizerConfig
+	conf := &config{
+		Listen:            envString("LISTEN_ADDR", ":8000"),
+		TLSCert:           os.Getenv("TLS_CERT"),
+		TLSKey:            os.Getenv("TLS_KEY"),
+		ReadHeaderTimeout: duration(10 * time.Second),
+		ReadTimeout:       duration(30 * time.Second),
+		WriteTimeout:      duration(rwgps.DefaultHandlerConfig.Timeout + 30*time.Second),
+		IdleTimeout:       duration(2 * time.Minute),
+		ShutdownTimeout:   duration(rwgps.DefaultHandlerConfig.Timeout + 10*time.Second),
+		RateBurst:         10,
+		Timeout:           duration(rwgps.DefaultHandlerConfig.Timeout),
+		FetchTimeout:      duration(rwgps.DefaultHandlerConfig.FetchTimeout),
+		StopsTimeout:      duration(cafes.FetchTimeout),
+		MaxSize:           rwgps.DefaultHandlerConfig.MaxSize,
+		MaxPoints:         rwgps.DefaultHandlerConfig.MaxPoints,
+		CacheTTL:          duration(rwgps.DefaultHandlerConfig.CacheTTL),
+		CacheDir:          os.Getenv("CACHE_DIR"),
+		RWGPSURL:          os.Getenv("RWGPS_BASE_URL"),
+		Library:           os.Getenv("RIDE_LIBRARY"),
+		WidgetTemplates:   os.Getenv("WIDGET_TEMPLATES"),
+		WatchCallback:     os.Getenv("WATCH_CALLBACK"),
+		WatchInterval:     duration(rwgps.DefaultWatchConfig.Interval),
+		WatchSecret:       os.Getenv("WATCH_SECRET"),
+		MinimumSettlement: envString("MINIMUM_SETTLEMENT", "Other Settlement"),
+	}
+	if v := os.Getenv("CORS_ORIGINS"); v != "" {
+		conf.CORSOrigins.Set(v)
+	}
+	if v := os.Getenv("WATCH_ROUTES"); v != "" {
+		conf.WatchRoutes.Set(v)
+	}
+	var err error
+	floats := []struct {
+		name string
+		v    *float64
+		def  float64
+	}{
+		{"RATE_LIMIT", &conf.RateLimit, 0},
+		{"STOP_SEARCH_RECTANGLE", &conf.StopSearchRectangle, defaults.CoffeeStopSearchRectangleSize},
+		{"STOP_DUPLICATE_DISTANCE", &conf.StopDuplicateDistance, defaults.CoffeeStopDuplicateDistance},
+		{"POI_DUPLICATE_DISTANCE", &conf.POIDuplicateDistance, defaults.PointOfInterestDuplicateDistance},
+		{"POI_MINIMUM_DISTANCE", &conf.POIMinimumDistance, defaults.PointOfInterestMinimumDistance},
+	}
+	for _, f := range floats {
+		if *f.v, err = envFloat(f.name, f.def); err != nil {
+			return nil, err
+		}
+	}
+	return conf, nil
+}
+
+// parseConfig reads the settings from the environment, the config file named by the -config
+// flag or CONFIG_FILE environment variable, and the command line flags.
+func parseConfig(fs *flag.FlagSet, args []string) (*config, error) {
+	conf, err := defaultConfig()
+	if err != nil {
+		return nil, err
+	}
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "JSON file of settings, overridden by flags")
+	fs.StringVar(&conf.Listen, "listen", conf.Listen, "Address to listen on")
+	fs.StringVar(&conf.TLSCert, "tls-cert", conf.TLSCert, "TLS certificate file; serves HTTPS if given with -tls-key")
+	fs.StringVar(&conf.TLSKey, "tls-key", conf.TLSKey, "TLS private key file")
+	fs.Var(&conf.ReadHeaderTimeout, "read-header-timeout", "Time allowed to read request headers")
+	fs.Var(&conf.ReadTimeout, "read-timeout", "Time allowed to read a request, including an uploaded GPX file")
+	fs.Var(&conf.WriteTimeout, "write-timeout", "Time allowed to handle a request and write the response")
+	fs.Var(&conf.IdleTimeout, "idle-timeout", "Time an idle keep-alive connection is kept open")
+	fs.Var(&conf.ShutdownTimeout, "shutdown-timeout", "Time allowed for requests in progress to finish on shutdown")
+	fs.Var(&conf.CORSOrigins, "cors-origins", "Comma-separated origins allowed to make cross-origin requests, or * for any")
+	fs.Float64Var(&conf.RateLimit, "rate-limit", conf.RateLimit, "Requests per second allowed from each client (0 for no limit)")
+	fs.IntVar(&conf.RateBurst, "rate-burst", conf.RateBurst, "Requests a client may make at once before being rate limited")
+	fs.BoolVar(&conf.TrustProxy, "trust-proxy", conf.TrustProxy, "Identify clients by the X-Forwarded-For header set by a reverse proxy")
+	fs.Var(&conf.Timeout, "timeout", "Time allowed to fetch and summarize a route")
+	fs.Var(&conf.FetchTimeout, "fetch-timeout", "Time allowed to fetch a route from RideWithGPS")
+	fs.Var(&conf.StopsTimeout, "stops-timeout", "Time allowed to fetch a list of refreshment stops")
+	fs.Int64Var(&conf.MaxSize, "max-size", conf.MaxSize, "Maximum size (in bytes) of a GPX track, uploaded or fetched from any route source")
+	fs.IntVar(&conf.MaxPoints, "max-points", conf.MaxPoints, "Maximum number of points in a track")
+	fs.Var(&conf.CacheTTL, "cache-ttl", "Time routes and summaries are cached (0 disables caching)")
+	fs.StringVar(&conf.CacheDir, "cache-dir", conf.CacheDir, "Directory to store cached routes")
+	fs.StringVar(&conf.RWGPSURL, "rwgps-url", conf.RWGPSURL, "RideWithGPS site (default "+rwgps.DefaultBaseURL+")")
+	fs.StringVar(&conf.Library, "library", conf.Library, "Ride library to search, as built by ride-library")
+	fs.Var(&conf.WatchRoutes, "watch-routes", "Comma-separated routes to re-summarize when they change: route IDs, URLs or /rwgps query strings")
+	fs.StringVar(&conf.WatchCallback, "watch-callback", conf.WatchCallback, "URL to POST the changed summaries of watched routes to")
+	fs.Var(&conf.WatchInterval, "watch-interval", "Time between checks of watched routes (0 to rely on webhooks)")
+	fs.StringVar(&conf.WidgetTemplates, "widget-templates", conf.WidgetTemplates, "Directory of NAME.html templates for embeddable widgets")
+	fs.Float64Var(&conf.StopSearchRectangle, "sr", conf.StopSearchRectangle, "Default size (m) of the rectangle we search for coffee stops near the route")
+	fs.Float64Var(&conf.StopDuplicateDistance, "sdd", conf.StopDuplicateDistance, "Default distance (km) within which recurrences of coffee stops are suppressed")
+	fs.Float64Var(&conf.POIDuplicateDistance, "dd", conf.POIDuplicateDistance, "Default distance (km) within which recurrences of points of interest are suppressed")
+	fs.Float64Var(&conf.POIMinimumDistance, "md", conf.POIMinimumDistance, "Default minimum distance (km) between points of interest")
+	fs.StringVar(&conf.MinimumSettlement, "ms", conf.MinimumSettlement, "Default smallest populated place reported (City, Town, Village, Hamlet, Other Settlement)")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if *configFile != "" {
+		// The flags are bound to conf, so note those given before the file overwrites them
+		set := make(map[string]string)
+		fs.Visit(func(f *flag.Flag) {
+			set[f.Name] = f.Value.String()
+		})
+		if err := conf.load(*configFile); err != nil {
+			return nil, err
+		}
+		for name, v := range set {
+			fs.Set(name, v)
+		}
+	}
+	return conf, conf.validate()
+}
+
+// load overrides conf with the settings in a JSON file. Settings missing from the file are
+// left unchanged.
+func (conf *config) load(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %v", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(conf); err != nil {
+		return fmt.Errorf("error parsing config file %s: %v", filename, err)
+	}
+	return nil
+}
+
+func (conf *config) validate() error {
+	if (conf.TLSCert == "") != (conf.TLSKey == "") {
+		return errors.New("tls-cert and tls-key must be given together")
+	}
+	if conf.RateLimit < 0 {
+		return fmt.Errorf("invalid rate-limit %g: must not be negative", conf.RateLimit)
+	}
+	if conf.RateLimit > 0 && conf.RateBurst < 1 {
+		return fmt.Errorf("invalid rate-burst %d: must be at least 1", conf.RateBurst)
+	}
+	if len(conf.WatchRoutes) > 0 && conf.WatchCallback == "" {
+		return errors.New("watch-routes requires watch-callback")
+	}
+	if conf.WriteTimeout > 0 && conf.WriteTimeout <= conf.Timeout {
+		log.Printf("Warning: write-timeout %s is not longer than timeout %s, so slow summaries will be cut off", conf.WriteTimeout, conf.Timeout)
+	}
+	return nil
+}
+
+// duration is a time.Duration that can be set from a flag or a JSON string such as "30s".
+type duration time.Duration
+
+func (d duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("invalid duration %s: expected a string such as \"30s\"", data)
+	}
+	return d.Set(s)
+}
+
+// stringList is a list set from a comma-separated flag or a JSON array.
+type stringList []string
+
+func (l stringList) String() string {
+	return strings.Join(l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = nil
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// envString returns the value of the environment variable name, or def if it is not set.
+func envString(name string, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// envFloat returns the numeric value of the environment variable name, or def if it is not set.
+func envFloat(name string, def float64) (float64, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %s", name, v)
+	}
+	return f, nil
+}
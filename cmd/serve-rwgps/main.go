@@ -1,23 +1,144 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sync"
+	"time"
 
+	"github.com/ray1729/gpx-utils/pkg/cafes"
+	"github.com/ray1729/gpx-utils/pkg/library"
+	"github.com/ray1729/gpx-utils/pkg/metrics"
+	"github.com/ray1729/gpx-utils/pkg/placenames"
 	"github.com/ray1729/gpx-utils/pkg/rwgps"
+	"github.com/ray1729/gpx-utils/pkg/sources"
+	"github.com/ray1729/gpx-utils/pkg/webui"
 )
 
 func main() {
-	listenAddr := os.Getenv("LISTEN_ADDR")
-	if listenAddr == "" {
-		listenAddr = ":8000"
-	}
-	rwgpsHandler, err := rwgps.NewHandler()
+	conf, err := parseConfig(flag.CommandLine, os.Args[1:])
 	if err != nil {
 		log.Fatal(err)
 	}
-	http.Handle("/rwgps", rwgpsHandler)
-	log.Printf("Listening for requests on %s", listenAddr)
-	log.Fatal(http.ListenAndServe(listenAddr, nil))
+	reg := metrics.NewRegistry()
+	// Record the latency of the requests this server makes to upstream services
+	upstream := instrumentTransport(http.DefaultTransport, reg)
+	cafes.FetchTimeout = time.Duration(conf.StopsTimeout)
+	cafes.HTTPClient = &http.Client{Transport: upstream}
+	opts := []rwgps.HandlerOption{
+		rwgps.WithTimeout(time.Duration(conf.Timeout)),
+		rwgps.WithFetchTimeout(time.Duration(conf.FetchTimeout)),
+		rwgps.WithMaxSize(conf.MaxSize),
+		rwgps.WithMaxPoints(conf.MaxPoints),
+		rwgps.WithCache(time.Duration(conf.CacheTTL), conf.CacheDir),
+		rwgps.WithSources(sources.FromEnv(&http.Client{Timeout: time.Duration(conf.FetchTimeout), Transport: upstream}, conf.MaxSize)),
+		rwgps.WithTransport(upstream),
+		rwgps.WithRWGPS(conf.RWGPSURL, os.Getenv("RWGPS_API_KEY"), os.Getenv("RWGPS_AUTH_TOKEN")),
+		rwgps.WithSummarizerOptions(
+			placenames.WithCoffeeStopSearchRectangleSize(conf.StopSearchRectangle),
+			placenames.WithCoffeeStopDuplicateDistance(conf.StopDuplicateDistance),
+			placenames.WithPointOfInterestDuplicateDistance(conf.POIDuplicateDistance),
+			placenames.WithPointOfInterestMinimumDistance(conf.POIMinimumDistance),
+			placenames.WithMinimumSettlement(conf.MinimumSettlement),
+		),
+	}
+
+	a := &app{}
+	registerStats(reg, a)
+	ctx, cancel := shutdownContext()
+	defer cancel()
+	// The loader holds background until it has started the watcher, which then holds it. If
+	// loading fails the server shuts down, and the error is reported once it has stopped.
+	var background sync.WaitGroup
+	loadErr := make(chan error, 1)
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		if err := load(ctx, conf, opts, a, &background); err != nil {
+			log.Printf("Loading failed, shutting down")
+			loadErr <- err
+			cancel()
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.Handle("/", a)
+	if conf.Library != "" {
+		search, err := library.NewSearchHandler(conf.Library)
+		if err != nil {
+			log.Fatal(err)
+		}
+		mux.Handle("/search", search)
+	}
+	mux.Handle("/metrics", reg)
+	mux.HandleFunc("/healthz", serveHealth)
+	mux.HandleFunc("/readyz", a.serveReady)
+	var handler http.Handler = mux
+	if conf.RateLimit > 0 {
+		handler = newRateLimiter(conf.RateLimit, conf.RateBurst, conf.TrustProxy).limit(handler)
+	}
+	handler = cors(handler, conf.CORSOrigins)
+	if err := serve(ctx, conf, observe(handler, reg), a); err != nil {
+		log.Fatal(err)
+	}
+	background.Wait()
+	select {
+	case err := <-loadErr:
+		log.Fatalf("Error starting server: %v", err)
+	default:
+	}
+}
+
+// load creates the handlers that need the place index, which takes a few seconds to load,
+// and sets them on a. If routes are watched, it starts the watcher, adding it to background.
+func load(ctx context.Context, conf *config, opts []rwgps.HandlerOption, a *app, background *sync.WaitGroup) error {
+	started := time.Now()
+	rwgpsHandler, err := rwgps.NewHandler(opts...)
+	if err != nil {
+		return err
+	}
+	ui, err := webui.NewHandler(rwgpsHandler)
+	if err != nil {
+		return err
+	}
+	widget, err := webui.NewWidget(rwgpsHandler, conf.WidgetTemplates)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", ui)
+	mux.Handle("/widget", widget)
+	mux.Handle("/widget.js", widget)
+	mux.Handle("/rwgps", rwgpsHandler)
+	mux.HandleFunc("/summarize", rwgpsHandler.ServeSummarize)
+	if len(conf.WatchRoutes) > 0 {
+		watchOpts := []rwgps.WatchOption{
+			rwgps.WithWatchInterval(time.Duration(conf.WatchInterval)),
+			rwgps.WithWatchSecret(conf.WatchSecret),
+		}
+		if conf.CacheDir != "" {
+			watchOpts = append(watchOpts, rwgps.WithWatchStateFile(filepath.Join(conf.CacheDir, "watch.json")))
+		}
+		watcher, err := rwgps.NewWatcher(rwgpsHandler, conf.WatchCallback, conf.WatchRoutes, watchOpts...)
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			// The server shut down while the index was loading
+			return nil
+		}
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			watcher.Run(ctx)
+		}()
+		mux.HandleFunc("/webhook", watcher.ServeWebhook)
+	}
+	a.set(rwgpsHandler, mux)
+	log.Printf("Loaded place index in %s", time.Since(started).Round(time.Millisecond))
+	return nil
 }
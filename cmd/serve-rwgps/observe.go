@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ray1729/gpx-utils/pkg/metrics"
+	"github.com/ray1729/gpx-utils/pkg/requestid"
+	"github.com/ray1729/gpx-utils/pkg/rwgps"
+)
+
+// app serves the summarizer endpoints once the place index has loaded, and 503 Service
+// Unavailable until then, so the server can answer health checks while it starts up.
+type app struct {
+	v        atomic.Value // *loadedApp
+	draining int32        // set when the server is shutting down
+}
+
+type loadedApp struct {
+	rwgps   *rwgps.RWGPSHandler
+	handler http.Handler
+}
+
+func (a *app) set(h *rwgps.RWGPSHandler, handler http.Handler) {
+	a.v.Store(&loadedApp{rwgps: h, handler: handler})
+}
+
+// shutdown marks the server as shutting down, so that it is no longer reported ready.
+func (a *app) shutdown() {
+	atomic.StoreInt32(&a.draining, 1)
+}
+
+// loaded returns the loaded app, or nil if it is still loading.
+func (a *app) loaded() *loadedApp {
+	l, _ := a.v.Load().(*loadedApp)
+	return l
+}
+
+func (a *app) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l := a.loaded()
+	if l == nil {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "starting up: loading place index", http.StatusServiceUnavailable)
+		return
+	}
+	l.handler.ServeHTTP(w, r)
+}
+
+// serveHealth reports that the server is running.
+func serveHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// serveReady reports whether the place index has loaded, so the server can summarize routes,
+// and the server is not shutting down.
+func (a *app) serveReady(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&a.draining) != 0 {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "shutting down", "placeIndex": "loaded"})
+		return
+	}
+	if a.loaded() == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "loading", "placeIndex": "loading"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready", "placeIndex": "loaded"})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// registerStats registers the metrics kept by the summarizer and caches of a.
+func registerStats(reg *metrics.Registry, a *app) {
+	stat := func(f func(l *loadedApp) float64) func() float64 {
+		return func() float64 {
+			if l := a.loaded(); l != nil {
+				return f(l)
+			}
+			return 0
+		}
+	}
+	reg.NewGaugeFunc("place_index_loaded", "Whether the place index has loaded (1) or not (0).", stat(func(l *loadedApp) float64 {
+		return 1
+	}))
+	reg.NewCounterFunc("summarizer_tracks_total", "Tracks summarized.", stat(func(l *loadedApp) float64 {
+		return float64(l.rwgps.SummarizerStats().Tracks)
+	}))
+	reg.NewCounterFunc("summarizer_points_total", "Track points summarized.", stat(func(l *loadedApp) float64 {
+		return float64(l.rwgps.SummarizerStats().Points)
+	}))
+	reg.NewCounterFunc("summarizer_seconds_total", "Time spent summarizing tracks; divide into summarizer_points_total for points per second.", stat(func(l *loadedApp) float64 {
+		return l.rwgps.SummarizerStats().Duration.Seconds()
+	}))
+	reg.NewCounterFunc("stops_cache_hits_total", "Refreshment stops lookups served from the cache.", stat(func(l *loadedApp) float64 {
+		return float64(l.rwgps.StopsStats().Hits)
+	}))
+	reg.NewCounterFunc("stops_cache_misses_total", "Refreshment stops lookups that fetched stops not yet cached.", stat(func(l *loadedApp) float64 {
+		return float64(l.rwgps.StopsStats().Misses)
+	}))
+	reg.NewCounterFunc("stops_cache_refreshes_total", "Refreshment stops lookups that refetched expired stops.", stat(func(l *loadedApp) float64 {
+		return float64(l.rwgps.StopsStats().Refreshes)
+	}))
+	reg.NewCounterFunc("stops_cache_errors_total", "Failed fetches of refreshment stops.", stat(func(l *loadedApp) float64 {
+		return float64(l.rwgps.StopsStats().Errors)
+	}))
+	reg.NewCounterFunc("route_cache_hits_total", "Route lookups served from the cache.", stat(func(l *loadedApp) float64 {
+		return float64(l.rwgps.CacheStats().Hits)
+	}))
+	reg.NewCounterFunc("route_cache_misses_total", "Route lookups that fetched or summarized the route.", stat(func(l *loadedApp) float64 {
+		return float64(l.rwgps.CacheStats().Misses)
+	}))
+	reg.NewCounterFunc("route_cache_revalidations_total", "Route lookups served after checking the route is unchanged.", stat(func(l *loadedApp) float64 {
+		return float64(l.rwgps.CacheStats().Revalidations)
+	}))
+	reg.NewCounterFunc("route_cache_errors_total", "Route lookups that failed.", stat(func(l *loadedApp) float64 {
+		return float64(l.rwgps.CacheStats().Errors)
+	}))
+}
+
+// instrumentedTransport records the latency and errors of requests to upstream services.
+type instrumentedTransport struct {
+	next     http.RoundTripper
+	duration *metrics.Histogram
+	errors   *metrics.Counter
+}
+
+func instrumentTransport(next http.RoundTripper, reg *metrics.Registry) http.RoundTripper {
+	return &instrumentedTransport{
+		next:     next,
+		duration: reg.NewHistogram("upstream_request_duration_seconds", "Latency of requests to upstream services.", metrics.DefaultBuckets, "host"),
+		errors:   reg.NewCounter("upstream_errors_total", "Requests to upstream services that failed or returned a server error.", "host"),
+	}
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	started := time.Now()
+	res, err := t.next.RoundTrip(req)
+	t.duration.Observe(time.Since(started).Seconds(), req.URL.Host)
+	if err != nil || res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests {
+		t.errors.Inc(req.URL.Host)
+	}
+	return res, err
+}
+
+// requestLog is a structured log entry for a request.
+type requestLog struct {
+	Time     time.Time `json:"time"`
+	ID       string    `json:"id"`
+	Remote   string    `json:"remote"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Query    string    `json:"query,omitempty"`
+	Status   int       `json:"status"`
+	Bytes    int64     `json:"bytes"`
+	Duration float64   `json:"durationMs"`
+	Cache    string    `json:"cache,omitempty"`
+}
+
+// observe logs each request as a line of JSON and records request metrics. Each request is
+// given an ID, which is returned in the X-Request-ID header and carried in the request context
+// for handlers to log; a valid ID sent by a proxy in the same header is used instead.
+func observe(next http.Handler, reg *metrics.Registry) http.Handler {
+	requests := reg.NewCounter("http_requests_total", "HTTP requests by handler, method and status code.", "handler", "method", "code")
+	duration := reg.NewHistogram("http_request_duration_seconds", "Latency of HTTP requests by handler.", metrics.DefaultBuckets, "handler")
+	logger := log.New(os.Stderr, "", 0)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(requestid.NewContext(r.Context(), id)))
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		elapsed := time.Since(started)
+		handler := handlerLabel(r.URL.Path)
+		requests.Inc(handler, methodLabel(r.Method), strconv.Itoa(sw.status))
+		duration.Observe(elapsed.Seconds(), handler)
+		entry, err := json.Marshal(requestLog{
+			Time:     started.UTC(),
+			ID:       id,
+			Remote:   r.RemoteAddr,
+			Method:   r.Method,
+			Path:     r.URL.Path,
+			Query:    redactQuery(r.URL.RawQuery),
+			Status:   sw.status,
+			Bytes:    sw.bytes,
+			Duration: float64(elapsed.Microseconds()) / 1000,
+			Cache:    w.Header().Get("X-Cache"),
+		})
+		if err != nil {
+			log.Printf("Error marshalling request log: %v", err)
+			return
+		}
+		logger.Println(string(entry))
+	})
+}
+
+// Query parameters whose values are secret, and are not logged
+var secretParams = map[string]bool{
+	"token":        true,
+	"privacy_code": true,
+	"privacyCode":  true,
+	"secret":       true,
+	"key":          true,
+	"api_key":      true,
+	"apiKey":       true,
+	"auth_token":   true,
+	"access_token": true,
+}
+
+// redactQuery replaces the values of secret parameters in a query string, including those in
+// the query of a URL given as a parameter, such as a share link with a privacy code. A query
+// that cannot be parsed is left out.
+func redactQuery(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	q, err := url.ParseQuery(raw)
+	if err != nil {
+		return ""
+	}
+	for name, values := range q {
+		for i, v := range values {
+			switch {
+			case secretParams[name]:
+				values[i] = "REDACTED"
+			case strings.Contains(v, "?"):
+				if u, err := url.Parse(v); err == nil && u.RawQuery != "" {
+					u.RawQuery = redactQuery(u.RawQuery)
+					values[i] = u.String()
+				}
+			}
+		}
+	}
+	return q.Encode()
+}
+
+// handlerLabel returns the endpoint serving path, so that metrics are not labelled with
+// arbitrary paths.
+func handlerLabel(path string) string {
+	switch path {
+	case "/", "/rwgps", "/summarize", "/widget", "/widget.js", "/webhook", "/search", "/metrics", "/healthz", "/readyz":
+		return path
+	}
+	if strings.HasPrefix(path, "/static/") {
+		return "/static/"
+	}
+	return "other"
+}
+
+// methodLabel returns the request method, or "other" for unknown methods, so that metrics are
+// not labelled with arbitrary methods.
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions, http.MethodConnect, http.MethodTrace:
+		return method
+	}
+	return "other"
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// validRequestID reports whether id is safe to log and return: 1 to 64 letters, digits,
+// hyphens and underscores.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// statusWriter records the status and size of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
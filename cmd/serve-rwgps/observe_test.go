@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ray1729/gpx-utils/pkg/metrics"
+	"github.com/ray1729/gpx-utils/pkg/requestid"
+	"github.com/ray1729/gpx-utils/pkg/rwgps"
+)
+
+func TestRedactQuery(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want url.Values
+	}{
+		{"", nil},
+		{"routeId=1&stops=ctccambridge", url.Values{"routeId": {"1"}, "stops": {"ctccambridge"}}},
+		{"routeId=7&token=hush", url.Values{"routeId": {"7"}, "token": {"REDACTED"}}},
+		{
+			"url=" + url.QueryEscape("https://ridewithgps.com/routes/1?privacy_code=abc"),
+			url.Values{"url": {"https://ridewithgps.com/routes/1?privacy_code=REDACTED"}},
+		},
+	}
+	for _, tc := range tests {
+		got := redactQuery(tc.raw)
+		if tc.want == nil {
+			if got != "" {
+				t.Errorf("redactQuery(%q) = %q, want empty", tc.raw, got)
+			}
+			continue
+		}
+		if got != tc.want.Encode() {
+			t.Errorf("redactQuery(%q) = %q, want %q", tc.raw, got, tc.want.Encode())
+		}
+	}
+	if got := redactQuery("token=%zz"); got != "" {
+		t.Errorf("redactQuery of an invalid query = %q, want empty", got)
+	}
+}
+
+func TestObserveRequestID(t *testing.T) {
+	var seen string
+	h := observe(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestid.FromContext(r.Context())
+	}), metrics.NewRegistry())
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/rwgps?routeId=1", nil))
+	if id := rec.Header().Get("X-Request-ID"); id == "" || seen != id {
+		t.Errorf("handler saw request ID %q, response has %q", seen, id)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/rwgps?routeId=1", nil)
+	req.Header.Set("X-Request-ID", "proxy-123")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if seen != "proxy-123" || rec.Header().Get("X-Request-ID") != "proxy-123" {
+		t.Errorf("handler saw request ID %q, want the proxy's", seen)
+	}
+}
+
+func TestMethodLabel(t *testing.T) {
+	for method, want := range map[string]string{
+		"GET":                          "GET",
+		"POST":                         "POST",
+		"OPTIONS":                      "OPTIONS",
+		"get":                          "other",
+		"BREW":                         "other",
+		"X" + strings.Repeat("Y", 100): "other",
+	} {
+		if got := methodLabel(method); got != want {
+			t.Errorf("methodLabel(%q) = %q, want %q", method, got, want)
+		}
+	}
+}
+
+// TestPrivacyCodeNotLogged checks that the privacy code of a private trip appears in neither
+// the access log nor the messages logged by the handler.
+func TestPrivacyCodeNotLogged(t *testing.T) {
+	const secret = "s3cretc0de"
+	gpx, err := ioutil.ReadFile(filepath.Join("..", "..", "pkg", "placenames", "testdata", "fens-loop.gpx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Query().Get("privacy_code") != secret:
+			w.WriteHeader(http.StatusForbidden)
+		case r.URL.Path == "/trips/5.gpx":
+			w.Write(gpx)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer site.Close()
+	h, err := rwgps.NewHandler(rwgps.WithRWGPS(site.URL, "", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var appLog bytes.Buffer
+	log.SetOutput(&appLog)
+	defer log.SetOutput(os.Stderr)
+	accessLog, err := ioutil.TempFile(t.TempDir(), "access.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accessLog.Close()
+	stderr := os.Stderr
+	os.Stderr = accessLog
+	handler := observe(h, metrics.NewRegistry())
+	os.Stderr = stderr
+
+	for _, tc := range []struct {
+		link   string
+		status int
+	}{
+		{"https://ridewithgps.com/trips/5?privacy_code=" + secret, http.StatusOK},
+		{"https://ridewithgps.com/routes/6?privacy_code=" + secret, http.StatusBadGateway},
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/rwgps?url="+url.QueryEscape(tc.link), nil))
+		if rec.Code != tc.status {
+			t.Errorf("%s: got status %d, want %d", tc.link, rec.Code, tc.status)
+		}
+		if id := rec.Header().Get("X-Request-ID"); !strings.Contains(appLog.String(), "["+id+"]") {
+			t.Errorf("application log does not mention request %s:\n%s", id, appLog.String())
+		}
+	}
+	access, err := ioutil.ReadFile(accessLog.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(appLog.String(), "trips/5") || len(access) == 0 {
+		t.Fatalf("nothing logged:\n%s\n%s", appLog.String(), access)
+	}
+	if strings.Contains(appLog.String(), secret) {
+		t.Errorf("application log contains the privacy code:\n%s", appLog.String())
+	}
+	if strings.Contains(string(access), secret) {
+		t.Errorf("access log contains the privacy code:\n%s", access)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ray1729/gpx-utils/pkg/rwgps"
+)
+
+// shutdownContext returns a context that is cancelled when the server receives SIGINT or
+// SIGTERM, or cancel is called.
+func shutdownContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		select {
+		case s := <-sig:
+			log.Printf("Received %s, shutting down", s)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// serve runs the server until ctx is cancelled, then stops accepting connections and waits up
+// to conf.ShutdownTimeout for requests in progress to finish.
+func serve(ctx context.Context, conf *config, handler http.Handler, a *app) error {
+	srv := &http.Server{
+		Addr:              conf.Listen,
+		Handler:           handler,
+		ReadHeaderTimeout: time.Duration(conf.ReadHeaderTimeout),
+		ReadTimeout:       time.Duration(conf.ReadTimeout),
+		WriteTimeout:      time.Duration(conf.WriteTimeout),
+		IdleTimeout:       time.Duration(conf.IdleTimeout),
+	}
+	done := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		a.shutdown()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(conf.ShutdownTimeout))
+		defer cancel()
+		done <- srv.Shutdown(ctx)
+	}()
+	var err error
+	if conf.TLSCert != "" {
+		log.Printf("Listening for HTTPS requests on %s", conf.Listen)
+		err = srv.ListenAndServeTLS(conf.TLSCert, conf.TLSKey)
+	} else {
+		log.Printf("Listening for requests on %s", conf.Listen)
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+	if err := <-done; err != nil {
+		return err
+	}
+	log.Printf("Shut down cleanly")
+	return nil
+}
+
+// cors allows the listed origins, or any origin if the list contains "*", to call the server
+// from a browser, and answers preflight requests.
+func cors(next http.Handler, origins []string) http.Handler {
+	if len(origins) == 0 {
+		return next
+	}
+	allowed := make(map[string]bool)
+	for _, o := range origins {
+		allowed[strings.TrimRight(o, "/")] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !(allowed["*"] || allowed[origin]) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Set("Access-Control-Expose-Headers", "X-Cache, X-Request-ID, Retry-After")
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			h.Set("Access-Control-Allow-Headers", "Content-Type, X-Request-ID")
+			h.Set("Access-Control-Max-Age", "86400")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimiter limits the rate of requests from each client with a token bucket: a client may
+// make burst requests at once, then rate per second.
+type rateLimiter struct {
+	rate       float64
+	burst      float64
+	trustProxy bool
+	mu         sync.Mutex
+	clients    map[string]*bucket
+	lastPurge  time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int, trustProxy bool) *rateLimiter {
+	return &rateLimiter{
+		rate:       rate,
+		burst:      float64(burst),
+		trustProxy: trustProxy,
+		clients:    make(map[string]*bucket),
+		lastPurge:  time.Now(),
+	}
+}
+
+// allow reports whether the client may make a request now, and if not, how long it must wait.
+func (l *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.purge(now)
+	b := l.clients[client]
+	if b == nil {
+		b = &bucket{tokens: l.burst, last: now}
+		l.clients[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// purge forgets clients whose buckets have refilled, at most once a minute. It must be called
+// with l.mu held.
+func (l *rateLimiter) purge(now time.Time) {
+	if now.Sub(l.lastPurge) < time.Minute {
+		return
+	}
+	l.lastPurge = now
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for k, b := range l.clients {
+		if now.Sub(b.last) > full {
+			delete(l.clients, k)
+		}
+	}
+}
+
+// limit rejects requests from clients over the rate limit with status 429. Health checks,
+// metrics and static files are not limited.
+func (l *rateLimiter) limit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch handlerLabel(r.URL.Path) {
+		case "/healthz", "/readyz", "/metrics", "/static/":
+			next.ServeHTTP(w, r)
+			return
+		}
+		ok, wait := l.allow(clientIP(r, l.trustProxy), time.Now())
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(rwgps.Problem{
+				Type:   "about:blank",
+				Title:  http.StatusText(http.StatusTooManyRequests),
+				Status: http.StatusTooManyRequests,
+				Detail: "rate limit exceeded, try again later",
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the address of the client making r. Behind a reverse proxy, this is the
+// last address in the X-Forwarded-For header, which was added by the proxy.
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			parts := strings.Split(xff, ",")
+			return strings.TrimSpace(parts[len(parts)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/twpayne/go-gpx"
+
+	"github.com/ray1729/gpx-utils/pkg/track"
+)
+
+func main() {
+	log.SetFlags(0)
+	method := flag.String("method", "dp", "Simplification algorithm: dp (Douglas-Peucker) or vw (Visvalingam-Whyatt)")
+	tolerance := flag.Float64("tolerance", 0, "Discard points that deviate less than this distance (m) from the simplified track")
+	maxPoints := flag.Int("points", 0, "Simplify the track to at most this number of points")
+	interval := flag.Float64("resample", 0, "Resample the track to points this distance (m) apart before simplifying")
+	outFile := flag.String("o", "", "Write the simplified track to this file instead of STDOUT")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		log.Fatalf("Usage: %s [-method dp|vw] [-tolerance M] [-points N] [-resample M] [-o OUTFILE] GPX_FILE", os.Args[0])
+	}
+	g, points, err := track.ReadFile(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	n := len(points)
+	if *interval > 0 {
+		points = track.Resample(points, *interval)
+	}
+	switch *method {
+	case "dp":
+		if *tolerance > 0 {
+			points = track.DouglasPeucker(points, *tolerance)
+		}
+		if *maxPoints > 0 {
+			points = track.DouglasPeuckerCount(points, *maxPoints)
+		}
+	case "vw":
+		if *tolerance > 0 || *maxPoints > 0 {
+			points = track.Visvalingam(points, *tolerance, *maxPoints)
+		}
+	default:
+		log.Fatalf("Invalid method: %s", *method)
+	}
+	log.Printf("Reduced %d points to %d", n, len(points))
+	var name string
+	if len(g.Trk) > 0 {
+		name = g.Trk[0].Name
+	}
+	if err := writeGPX(*outFile, track.ToGPX(name, g.Metadata, points)); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func writeGPX(filename string, g *gpx.GPX) error {
+	if filename == "" {
+		return track.WriteGPX(os.Stdout, g)
+	}
+	wc, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("error creating output file %s: %v", filename, err)
+	}
+	if err := track.WriteGPX(wc, g); err != nil {
+		wc.Close()
+		return fmt.Errorf("error writing %s: %v", filename, err)
+	}
+	if err := wc.Close(); err != nil {
+		return fmt.Errorf("error closing file %s: %v", filename, err)
+	}
+	return nil
+}
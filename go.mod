@@ -1,6 +1,6 @@
 module github.com/ray1729/gpx-utils
 
-go 1.13
+go 1.16
 
 require (
 	github.com/cpuguy83/go-md2man/v2 v2.0.0 // indirect
@@ -11,6 +11,7 @@ require (
 	github.com/twpayne/go-gpx v1.2.0
 	github.com/urfave/cli/v2 v2.3.0
 	github.com/wlbr/mule v0.0.0-20200517121540-6f9faa2e2d0b // indirect
+	go.etcd.io/bbolt v1.3.6
 	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9 // indirect
 	golang.org/x/net v0.0.0-20210410081132-afb366fc7cd1 // indirect
 )
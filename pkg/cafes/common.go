@@ -1,9 +1,12 @@
 package cafes
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dhconnelly/rtreego"
@@ -12,6 +15,9 @@ import (
 // Size (in metres) of the bounding box around a stop
 const stopRectangleSize = 50
 
+// Maximum size (in bytes) of a downloaded list of stops
+const maxStopsSize = 50 << 20
+
 type RefreshmentStop struct {
 	Name     string
 	Url      string
@@ -26,7 +32,7 @@ func (s *RefreshmentStop) Bounds() *rtreego.Rect {
 
 func (s *RefreshmentStop) Contains(p rtreego.Point) bool {
 	if len(p) != 2 {
-		panic("Expected a 2-dimensional point")
+		return false
 	}
 	bounds := s.Bounds()
 	for i := 0; i < 2; i++ {
@@ -51,9 +57,35 @@ type entry struct {
 	ready   chan struct{} // closed when res is ready
 }
 
+// FetchTimeout bounds the time taken to fetch and index a list of stops.
+var FetchTimeout = 60 * time.Second
+
+// HTTPClient is used to fetch lists of stops.
+var HTTPClient = http.DefaultClient
+
 type Cache struct {
 	mu      sync.Mutex
 	entries map[string]*entry
+	stats   CacheStats
+}
+
+// CacheStats counts the lookups made in a Cache. Misses are lookups of stops not yet fetched,
+// Refreshes lookups of stops that had expired, and Errors failed fetches.
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Refreshes uint64
+	Errors    uint64
+}
+
+// Stats returns the number of hits, misses, refreshes and errors so far.
+func (c *Cache) Stats() CacheStats {
+	return CacheStats{
+		Hits:      atomic.LoadUint64(&c.stats.Hits),
+		Misses:    atomic.LoadUint64(&c.stats.Misses),
+		Refreshes: atomic.LoadUint64(&c.stats.Refreshes),
+		Errors:    atomic.LoadUint64(&c.stats.Errors),
+	}
 }
 
 func New() *Cache {
@@ -61,29 +93,86 @@ func New() *Cache {
 }
 
 func (c *Cache) Get(k string) (*rtreego.Rtree, error) {
+	return c.GetContext(context.Background(), k)
+}
+
+// GetContext is like Get, but stops waiting when ctx is done. A fetch in progress is shared
+// by all callers, so it is not cancelled with ctx; it is bounded by FetchTimeout instead.
+// Failed fetches are not cached.
+func (c *Cache) GetContext(ctx context.Context, k string) (*rtreego.Rtree, error) {
 	c.mu.Lock()
 	e := c.entries[k]
 	if e == nil || e.expires.Before(time.Now()) {
+		if e == nil {
+			atomic.AddUint64(&c.stats.Misses, 1)
+		} else {
+			atomic.AddUint64(&c.stats.Refreshes, 1)
+		}
 		e = &entry{ready: make(chan struct{}), expires: time.Now().Add(4 * time.Hour)}
 		c.entries[k] = e
 		c.mu.Unlock()
-		e.res.value, e.res.err = FetchStops(k)
-		close(e.ready)
+		go c.fetch(k, e)
 	} else {
 		c.mu.Unlock()
-		<-e.ready
+		atomic.AddUint64(&c.stats.Hits, 1)
+	}
+	select {
+	case <-e.ready:
+		return e.res.value, e.res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Cache) fetch(k string, e *entry) {
+	ctx, cancel := context.WithTimeout(context.Background(), FetchTimeout)
+	defer cancel()
+	e.res.value, e.res.err = FetchStopsContext(ctx, k)
+	if e.res.err != nil {
+		atomic.AddUint64(&c.stats.Errors, 1)
+		c.mu.Lock()
+		if c.entries[k] == e {
+			delete(c.entries, k)
+		}
+		c.mu.Unlock()
 	}
-	return e.res.value, e.res.err
+	close(e.ready)
+}
+
+var (
+	ErrInvalidStops = errors.New("invalid stops")
+	ErrUpstream     = errors.New("error fetching stops")
+)
+
+// UpstreamError reports a failure to fetch or index stops from their source. It matches
+// ErrUpstream, and unwraps to the underlying error.
+type UpstreamError struct {
+	URL string
+	Err error
 }
 
-var ErrInvalidStops = errors.New("invalid stops")
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("error fetching stops from %s: %v", e.URL, e.Err)
+}
+
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+func (e *UpstreamError) Is(target error) bool {
+	return target == ErrUpstream
+}
 
 func FetchStops(k string) (*rtreego.Rtree, error) {
+	return FetchStopsContext(context.Background(), k)
+}
+
+func FetchStopsContext(ctx context.Context, k string) (*rtreego.Rtree, error) {
 	switch k {
 	case "ctccambridge":
-		return FetchCtcCamIndex()
+		return FetchCtcCamIndexContext(ctx)
 	case "cyclingmaps":
-		return FetchCyclingMapsIndex()
+		return FetchCyclingMapsIndexContext(ctx)
 	default:
 		return nil, fmt.Errorf("%w: %s", ErrInvalidStops, k)
 	}
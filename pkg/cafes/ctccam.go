@@ -1,6 +1,7 @@
 package cafes
 
 import (
+	"context"
 	"encoding/xml"
 	"fmt"
 	"io"
@@ -53,23 +54,27 @@ func BuildCtcCamIndex(r io.Reader) (*rtreego.Rtree, error) {
 }
 
 func FetchCtcCamIndex() (*rtreego.Rtree, error) {
+	return FetchCtcCamIndexContext(context.Background())
+}
+
+func FetchCtcCamIndexContext(ctx context.Context) (*rtreego.Rtree, error) {
 	log.Printf("Fetching %s", ctcCamWaypointsUrl)
-	req, err := http.NewRequest(http.MethodGet, ctcCamWaypointsUrl, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ctcCamWaypointsUrl, nil)
 	if err != nil {
 		return nil, fmt.Errorf("error constructing waypoints request: %v", err)
 	}
 	req.Header.Set("User-Agent", "gpx-utils")
-	res, err := http.DefaultClient.Do(req)
+	res, err := HTTPClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("error getting %s: %v", ctcCamWaypointsUrl, err)
+		return nil, &UpstreamError{ctcCamWaypointsUrl, err}
 	}
 	defer res.Body.Close()
 	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status fetching %s: %s", ctcCamWaypointsUrl, res.Status)
+		return nil, &UpstreamError{ctcCamWaypointsUrl, fmt.Errorf("unexpected status %s", res.Status)}
 	}
-	index, err := BuildCtcCamIndex(res.Body)
+	index, err := BuildCtcCamIndex(io.LimitReader(res.Body, maxStopsSize))
 	if err != nil {
-		return nil, fmt.Errorf("error building CTC Cambridge stops index: %v", err)
+		return nil, &UpstreamError{ctcCamWaypointsUrl, fmt.Errorf("error building CTC Cambridge stops index: %v", err)}
 	}
 	log.Printf("Loaded %d CTC Cambridge stops", index.Size())
 	return index, nil
@@ -1,6 +1,7 @@
 package cafes
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -54,18 +55,27 @@ func BuildCyclingMapsIndex(r io.Reader) (*rtreego.Rtree, error) {
 }
 
 func FetchCyclingMapsIndex() (*rtreego.Rtree, error) {
+	return FetchCyclingMapsIndexContext(context.Background())
+}
+
+func FetchCyclingMapsIndexContext(ctx context.Context) (*rtreego.Rtree, error) {
 	log.Printf("Fetching %s", cyclingMapsCafesUrl)
-	res, err := http.Get(cyclingMapsCafesUrl)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cyclingMapsCafesUrl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error constructing cafes request: %v", err)
+	}
+	req.Header.Set("User-Agent", "gpx-utils")
+	res, err := HTTPClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("error getting %s: %v", cyclingMapsCafesUrl, err)
+		return nil, &UpstreamError{cyclingMapsCafesUrl, err}
 	}
 	defer res.Body.Close()
 	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status fetching %s: %s", cyclingMapsCafesUrl, res.Status)
+		return nil, &UpstreamError{cyclingMapsCafesUrl, fmt.Errorf("unexpected status %s", res.Status)}
 	}
-	index, err := BuildCyclingMapsIndex(res.Body)
+	index, err := BuildCyclingMapsIndex(io.LimitReader(res.Body, maxStopsSize))
 	if err != nil {
-		return nil, fmt.Errorf("error building cyclingmaps.net cafe stops index: %v", err)
+		return nil, &UpstreamError{cyclingMapsCafesUrl, fmt.Errorf("error building cyclingmaps.net cafe stops index: %v", err)}
 	}
 	log.Printf("Loaded %d cyclingmaps.net stops", index.Size())
 	return index, nil
@@ -0,0 +1,28 @@
+package library
+
+import (
+	"path"
+	"sort"
+	"time"
+)
+
+// RideDate determines the date of a ride: a YYYY-MM-DD prefix of the file name if there is
+// one, otherwise the time recorded in its summary, otherwise the fallback.
+func RideDate(filename string, summaryTime, fallback time.Time) time.Time {
+	base := path.Base(filename)
+	if len(base) >= 10 {
+		if t, err := time.Parse("2006-01-02", base[:10]); err == nil {
+			return t
+		}
+	}
+	if !summaryTime.IsZero() {
+		return summaryTime
+	}
+	return fallback
+}
+
+func sortByDate(rides []*Ride) {
+	sort.SliceStable(rides, func(i, j int) bool {
+		return rides[i].Date.Before(rides[j].Date)
+	})
+}
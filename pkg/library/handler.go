@@ -0,0 +1,154 @@
+package library
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ray1729/gpx-utils/pkg/requestid"
+)
+
+// SearchHandler serves route searches against a library. The rides are read into memory
+// when the handler is created, and read again in the background when the library file
+// changes, so the library is only locked briefly and can be re-indexed while the server is
+// running. Searches use the rides last read until the new ones are ready.
+type SearchHandler struct {
+	filename string
+	mu       sync.Mutex
+	rides    []*Ride
+	modTime  time.Time
+	size     int64
+	loading  bool
+}
+
+func NewSearchHandler(filename string) (*SearchHandler, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening library %s: %v", filename, err)
+	}
+	rides, err := readRides(filename)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Read %d rides from library %s", len(rides), filename)
+	return &SearchHandler{filename: filename, rides: rides, modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// load returns the rides last read from the library, starting to read them again if the
+// file has changed since.
+func (h *SearchHandler) load() ([]*Ride, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	info, err := os.Stat(h.filename)
+	if err != nil {
+		return h.rides, fmt.Errorf("error opening library %s: %v", h.filename, err)
+	}
+	if !h.loading && !(info.ModTime().Equal(h.modTime) && info.Size() == h.size) {
+		h.loading = true
+		go h.reload(info)
+	}
+	return h.rides, nil
+}
+
+// reload reads the rides from the library, waiting for the indexer to release its lock if
+// necessary. If the library cannot be read the rides previously read are kept.
+func (h *SearchHandler) reload(info os.FileInfo) {
+	rides, err := readRides(h.filename)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.loading = false
+	if err != nil {
+		log.Printf("Keeping the %d rides previously read: %v", len(h.rides), err)
+		return
+	}
+	h.rides, h.modTime, h.size = rides, info.ModTime(), info.Size()
+	log.Printf("Read %d rides from library %s", len(rides), h.filename)
+}
+
+func readRides(filename string) ([]*Ride, error) {
+	lib, err := OpenReadOnly(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer lib.Close()
+	rides := []*Ride{}
+	err = lib.Each(func(r *Ride) error {
+		rides = append(rides, r)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading library %s: %v", filename, err)
+	}
+	return rides, nil
+}
+
+func (h *SearchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	q, limit, err := parseRouteQuery(r)
+	if err != nil {
+		requestid.Println(ctx, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	requestid.Printf(ctx, "Handling search for start=%s via=%v finish=%s", q.Start, q.Via, q.Finish)
+	rides, err := h.load()
+	if err != nil {
+		// Carry on with the rides we have, which may be out of date
+		requestid.Println(ctx, err)
+	}
+	results := SearchRides(rides, q, limit)
+	if results == nil {
+		results = []SearchResult{}
+	}
+	data, err := json.Marshal(results)
+	if err != nil {
+		requestid.Printf(ctx, "Error marshalling JSON for search results: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func parseRouteQuery(r *http.Request) (RouteQuery, int, error) {
+	params := r.URL.Query()
+	q := RouteQuery{
+		Start:  params.Get("start"),
+		Via:    params["via"],
+		Finish: params.Get("finish"),
+	}
+	floats := []struct {
+		name string
+		ptr  *float64
+	}{
+		{"minDistance", &q.MinDistance},
+		{"maxDistance", &q.MaxDistance},
+		{"minAscent", &q.MinAscent},
+		{"maxAscent", &q.MaxAscent},
+	}
+	for _, f := range floats {
+		if s := params.Get(f.name); s != "" {
+			x, err := strconv.ParseFloat(s, 64)
+			if err != nil || x < 0 || math.IsNaN(x) || math.IsInf(x, 0) {
+				return q, 0, fmt.Errorf("invalid %s: %s", f.name, s)
+			}
+			*f.ptr = x
+		}
+	}
+	limit := 20
+	if s := params.Get("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 0 {
+			return q, 0, fmt.Errorf("invalid limit: %s", s)
+		}
+	}
+	return q, limit, nil
+}
@@ -0,0 +1,234 @@
+package library
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/ray1729/gpx-utils/pkg/placenames"
+)
+
+var ridesBucket = []byte("rides")
+
+var ErrNotFound = errors.New("ride not found")
+
+// Ride is the summary of a ride stored in the library.
+type Ride struct {
+	ID               string
+	Date             time.Time
+	Name             string
+	Link             string
+	Distance         float64
+	Ascent           float64
+	Start            string
+	Finish           string
+	PointsOfInterest []placenames.POI
+	Counties         map[string]int
+	RefreshmentStops []placenames.RefreshmentStop `json:",omitempty"`
+	Source           string                       // where the summary was read from
+	Modified         time.Time                    // modification time of the source when it was indexed
+}
+
+// NewRide constructs a library entry from a track summary.
+func NewRide(id string, date time.Time, s *placenames.TrackSummary) *Ride {
+	return &Ride{
+		ID:               id,
+		Date:             date,
+		Name:             s.Name,
+		Link:             s.Link,
+		Distance:         s.Distance,
+		Ascent:           s.Ascent,
+		Start:            s.Start,
+		Finish:           s.Finish,
+		PointsOfInterest: s.PointsOfInterest,
+		Counties:         s.Counties,
+		RefreshmentStops: s.RefreshmentStops,
+	}
+}
+
+// Library is a database of ride summaries stored in a single file.
+type Library struct {
+	db *bolt.DB
+}
+
+// Open opens the library stored in the named file, creating it if necessary.
+func Open(filename string) (*Library, error) {
+	return open(filename, false)
+}
+
+// OpenReadOnly opens an existing library for reading. Any number of processes may open the
+// same library read-only.
+func OpenReadOnly(filename string) (*Library, error) {
+	return open(filename, true)
+}
+
+func open(filename string, readOnly bool) (*Library, error) {
+	db, err := bolt.Open(filename, 0644, &bolt.Options{Timeout: 5 * time.Second, ReadOnly: readOnly})
+	if err != nil {
+		return nil, fmt.Errorf("error opening library %s: %v", filename, err)
+	}
+	if !readOnly {
+		err = db.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(ridesBucket)
+			return err
+		})
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("error initializing library %s: %v", filename, err)
+		}
+	}
+	return &Library{db: db}, nil
+}
+
+func (l *Library) Close() error {
+	return l.db.Close()
+}
+
+// Put adds or replaces a ride.
+func (l *Library) Put(r *Ride) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return l.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(ridesBucket).Put([]byte(r.ID), data)
+	})
+}
+
+// Get returns the ride with the given ID, or ErrNotFound.
+func (l *Library) Get(id string) (*Ride, error) {
+	var r Ride
+	err := l.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(ridesBucket)
+		if b == nil {
+			return ErrNotFound
+		}
+		data := b.Get([]byte(id))
+		if data == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(data, &r)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (l *Library) Delete(id string) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(ridesBucket).Delete([]byte(id))
+	})
+}
+
+// Each calls f for every ride in the library, in order of ID, stopping at the first error.
+func (l *Library) Each(f func(*Ride) error) error {
+	return l.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(ridesBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var r Ride
+			if err := json.Unmarshal(v, &r); err != nil {
+				return fmt.Errorf("error decoding ride %s: %v", k, err)
+			}
+			return f(&r)
+		})
+	})
+}
+
+// Query returns the rides matching q, ordered by date.
+func (l *Library) Query(q Query) ([]*Ride, error) {
+	var rides []*Ride
+	err := l.Each(func(r *Ride) error {
+		if q.Match(r) {
+			rides = append(rides, r)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortByDate(rides)
+	return rides, nil
+}
+
+// Query selects rides from the library. Zero-valued fields are ignored. Place names are
+// matched case-insensitively.
+type Query struct {
+	Start       string
+	Finish      string
+	Through     []string // the ride passes through all of these places
+	County      string
+	Stop        string // the ride passes a refreshment stop whose name contains this
+	MinDistance float64
+	MaxDistance float64
+	MinAscent   float64
+	MaxAscent   float64
+	From        time.Time
+	To          time.Time
+}
+
+func (q Query) Match(r *Ride) bool {
+	if q.Start != "" && !strings.EqualFold(q.Start, r.Start) {
+		return false
+	}
+	if q.Finish != "" && !strings.EqualFold(q.Finish, r.Finish) {
+		return false
+	}
+	for _, place := range q.Through {
+		if !r.PassesThrough(place) {
+			return false
+		}
+	}
+	if q.County != "" && !hasCounty(r, q.County) {
+		return false
+	}
+	if q.Stop != "" && !hasStop(r, q.Stop) {
+		return false
+	}
+	if (q.MinDistance > 0 && r.Distance < q.MinDistance) || (q.MaxDistance > 0 && r.Distance > q.MaxDistance) {
+		return false
+	}
+	if (q.MinAscent > 0 && r.Ascent < q.MinAscent) || (q.MaxAscent > 0 && r.Ascent > q.MaxAscent) {
+		return false
+	}
+	if (!q.From.IsZero() && r.Date.Before(q.From)) || (!q.To.IsZero() && !r.Date.Before(q.To)) {
+		return false
+	}
+	return true
+}
+
+// PassesThrough returns true if the named place is one of the ride's points of interest.
+func (r *Ride) PassesThrough(place string) bool {
+	for _, poi := range r.PointsOfInterest {
+		if strings.EqualFold(poi.Name, place) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasCounty(r *Ride, county string) bool {
+	for c := range r.Counties {
+		if strings.EqualFold(c, county) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasStop(r *Ride, name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range r.RefreshmentStops {
+		if strings.Contains(strings.ToLower(s.Name), name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package library
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/ray1729/gpx-utils/pkg/placenames"
+)
+
+// RouteQuery describes the route being searched for. Via places should be visited in the
+// given order. Zero-valued fields are ignored.
+type RouteQuery struct {
+	Start       string
+	Via         []string
+	Finish      string
+	MinDistance float64
+	MaxDistance float64
+	MinAscent   float64
+	MaxAscent   float64
+}
+
+// SearchResult is a ride matching a RouteQuery. Score is 1 for a ride meeting every
+// criterion, and smaller for rides that miss some places or fall outside the distance and
+// ascent ranges.
+type SearchResult struct {
+	Score float64
+	Ride  *Ride
+}
+
+// Search returns the rides that pass through at least one of the places in q, or all rides
+// within the distance and ascent ranges if q names no places, ordered by decreasing score.
+// If limit > 0 at most limit results are returned.
+func (l *Library) Search(q RouteQuery, limit int) ([]SearchResult, error) {
+	var results []SearchResult
+	err := l.Each(func(r *Ride) error {
+		if score := q.Score(r); score > 0 {
+			results = append(results, SearchResult{Score: score, Ride: r})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rank(results, limit), nil
+}
+
+// SearchRides is like Library.Search, but searches the given rides.
+func SearchRides(rides []*Ride, q RouteQuery, limit int) []SearchResult {
+	var results []SearchResult
+	for _, r := range rides {
+		if score := q.Score(r); score > 0 {
+			results = append(results, SearchResult{Score: score, Ride: r})
+		}
+	}
+	return rank(results, limit)
+}
+
+// rank orders results by decreasing score, then most recent first, and keeps at most limit.
+func rank(results []SearchResult, limit int) []SearchResult {
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Ride.Date.After(results[j].Ride.Date)
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// Score returns how closely r matches the query, between 0 (no match) and 1.
+func (q RouteQuery) Score(r *Ride) float64 {
+	var places, matched int
+	if q.Start != "" {
+		places++
+		if strings.EqualFold(q.Start, r.Start) {
+			matched++
+		}
+	}
+	if q.Finish != "" {
+		places++
+		if strings.EqualFold(q.Finish, r.Finish) {
+			matched++
+		}
+	}
+	if len(q.Via) > 0 {
+		places += len(q.Via)
+		matched += orderedMatches(q.Via, r.PointsOfInterest)
+	}
+	placeScore := 1.0
+	if places > 0 {
+		if matched == 0 {
+			return 0
+		}
+		placeScore = float64(matched) / float64(places)
+	}
+	if places == 0 && (outside(r.Distance, q.MinDistance, q.MaxDistance) > 0 || outside(r.Ascent, q.MinAscent, q.MaxAscent) > 0) {
+		return 0
+	}
+	return placeScore / (1 + outside(r.Distance, q.MinDistance, q.MaxDistance) + outside(r.Ascent, q.MinAscent, q.MaxAscent))
+}
+
+// outside returns how far x lies outside the range [min, max], relative to the nearest bound.
+// A zero bound is ignored.
+func outside(x, min, max float64) float64 {
+	if min > 0 && x < min {
+		return (min - x) / min
+	}
+	if max > 0 && x > max {
+		return (x - max) / max
+	}
+	return 0
+}
+
+// orderedMatches returns the largest number of the named places that the route passes
+// through in the given order (the longest common subsequence).
+func orderedMatches(names []string, pois []placenames.POI) int {
+	prev := make([]int, len(pois)+1)
+	cur := make([]int, len(pois)+1)
+	for _, name := range names {
+		for j, poi := range pois {
+			switch {
+			case strings.EqualFold(name, poi.Name):
+				cur[j+1] = prev[j] + 1
+			case prev[j+1] > cur[j]:
+				cur[j+1] = prev[j+1]
+			default:
+				cur[j+1] = cur[j]
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(pois)]
+}
@@ -0,0 +1,264 @@
+// Package metrics collects counters and histograms and serves them in the Prometheus text
+// exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds (in seconds) of the buckets of a latency histogram.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Registry holds the metrics served by a /metrics endpoint.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// Write writes all metrics in the Prometheus text format, in the order they were registered.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.Write(w)
+}
+
+// Counter is a count with optional labels, such as the number of requests by status code.
+type Counter struct {
+	desc
+	mu     sync.Mutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	labels []string
+	value  float64
+}
+
+// NewCounter registers a counter. The label values are given when it is incremented.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{desc: desc{name, help, "counter", labels}, series: make(map[string]*counterSeries)}
+	r.register(c)
+	return c
+}
+
+// Inc adds 1 to the count for the given label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative, to the count for the given label values.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k := seriesKey(labelValues)
+	s := c.series[k]
+	if s == nil {
+		s = &counterSeries{labels: append([]string(nil), labelValues...)}
+		c.series[k] = s
+	}
+	s.value += v
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, k := range sortedKeys(c.series) {
+		s := c.series[k]
+		c.writeSample(w, "", s.labels, "", "", s.value)
+	}
+}
+
+// Histogram counts observations, such as request durations, in buckets.
+type Histogram struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labels []string
+	counts []uint64 // counts[i] is the number of observations <= buckets[i]
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram registers a histogram with the given bucket upper bounds, which must be sorted.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		desc:    desc{name, help, "histogram", labels},
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+	r.register(h)
+	return h
+}
+
+// Observe records v for the given label values.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	k := seriesKey(labelValues)
+	s := h.series[k]
+	if s == nil {
+		s = &histogramSeries{labels: append([]string(nil), labelValues...), counts: make([]uint64, len(h.buckets))}
+		h.series[k] = s
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.writeHeader(w)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, k := range sortedKeys(h.series) {
+		s := h.series[k]
+		for i, le := range h.buckets {
+			h.writeSample(w, "_bucket", s.labels, "le", formatFloat(le), float64(s.counts[i]))
+		}
+		h.writeSample(w, "_bucket", s.labels, "le", "+Inf", float64(s.count))
+		h.writeSample(w, "_sum", s.labels, "", "", s.sum)
+		h.writeSample(w, "_count", s.labels, "", "", float64(s.count))
+	}
+}
+
+// funcMetric reports a value obtained when the metrics are written, such as a count kept
+// elsewhere.
+type funcMetric struct {
+	desc
+	f func() float64
+}
+
+// NewCounterFunc registers a counter whose value is returned by f.
+func (r *Registry) NewCounterFunc(name, help string, f func() float64) {
+	r.register(&funcMetric{desc{name, help, "counter", nil}, f})
+}
+
+// NewGaugeFunc registers a gauge whose value is returned by f.
+func (r *Registry) NewGaugeFunc(name, help string, f func() float64) {
+	r.register(&funcMetric{desc{name, help, "gauge", nil}, f})
+}
+
+func (m *funcMetric) write(w *bufio.Writer) {
+	m.writeHeader(w)
+	m.writeSample(w, "", nil, "", "", m.f())
+}
+
+// desc describes a metric.
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.typ)
+}
+
+// writeSample writes one sample line. If extraName is not empty, the label extraName=extraValue
+// follows the metric's own labels.
+func (d *desc) writeSample(w *bufio.Writer, suffix string, labelValues []string, extraName, extraValue string, v float64) {
+	w.WriteString(d.name)
+	w.WriteString(suffix)
+	var pairs []string
+	for i, name := range d.labels {
+		value := ""
+		if i < len(labelValues) {
+			value = labelValues[i]
+		}
+		pairs = append(pairs, name+`="`+escapeLabel(value)+`"`)
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+extraValue+`"`)
+	}
+	if len(pairs) > 0 {
+		w.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	w.WriteString(" " + formatFloat(v) + "\n")
+}
+
+func seriesKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]*counterSeries:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*histogramSeries:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -43,26 +43,35 @@ func FilterAreaGt(a float64) Filter {
 	}
 }
 
+// FilterHasBounds selects records with a valid minimum bounding rectangle.
+func FilterHasBounds() Filter {
+	return func(r *Record) bool {
+		return r.HasBounds()
+	}
+}
+
 // ProcessFile reads the compressed OS Open Names data set and calls the handler for each record.
-func ProcessFile(filename string, handler Handler, filters ...Filter) error {
+// Malformed records are skipped, and the number skipped is returned.
+func ProcessFile(filename string, handler Handler, filters ...Filter) (int, error) {
 	r, err := zip.OpenReader(filename)
 	if err != nil {
-		return fmt.Errorf("error opening %s for reading: %v", filename, err)
+		return 0, fmt.Errorf("error opening %s for reading: %v", filename, err)
 	}
 	defer r.Close()
 
+	skipped := 0
 	for _, f := range r.File {
 		if !(strings.HasPrefix(f.Name, "DATA/") && strings.HasSuffix(f.Name, ".csv")) {
 			continue
 		}
 		rc, err := f.Open()
 		if err != nil {
-			return fmt.Errorf("error opening %s: %v", filename, err)
+			return skipped, fmt.Errorf("error opening %s: %v", filename, err)
 		}
 		s, err := NewScanner(rc)
 		if err != nil {
 			rc.Close()
-			return fmt.Errorf("error reading %s: %v", f.Name, err)
+			return skipped, fmt.Errorf("error reading %s: %v", f.Name, err)
 		}
 		for s.Scan() {
 			r := s.Record()
@@ -70,16 +79,18 @@ func ProcessFile(filename string, handler Handler, filters ...Filter) error {
 				continue
 			}
 			if err := handler(r); err != nil {
-				return err
+				rc.Close()
+				return skipped + s.Skipped(), err
 			}
 		}
+		skipped += s.Skipped()
 		if err = s.Err(); err != nil {
 			rc.Close()
-			return fmt.Errorf("error parsing %s: %v", f.Name, err)
+			return skipped, fmt.Errorf("error parsing %s: %v", f.Name, err)
 		}
 		rc.Close()
 	}
-	return nil
+	return skipped, nil
 }
 
 func applyFilters(r *Record, filters []Filter) bool {
@@ -5,6 +5,7 @@ import (
 	"encoding/csv"
 	"errors"
 	"io"
+	"math"
 	"strconv"
 
 	"github.com/dhconnelly/rtreego"
@@ -47,11 +48,23 @@ type Record struct {
 	SameAsGeonames        string
 }
 
+// HasBounds reports whether the record has a minimum bounding rectangle of positive area.
+func (r *Record) HasBounds() bool {
+	for _, x := range []float64{r.MbrXMin, r.MbrYMin, r.MbrXMax, r.MbrYMax} {
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return false
+		}
+	}
+	return r.MbrXMax > r.MbrXMin && r.MbrYMax > r.MbrYMin
+}
+
+// Bounds returns the minimum bounding rectangle of the record. A record without one is
+// treated as a 1m square at its geometry point.
 func (r *Record) Bounds() *rtreego.Rect {
 	p := rtreego.Point{r.MbrXMin, r.MbrYMin}
 	rect, err := rtreego.NewRect(p, []float64{r.MbrXMax - r.MbrXMin, r.MbrYMax - r.MbrYMin})
 	if err != nil {
-		panic(err)
+		return rtreego.Point{r.GeomX, r.GeomY}.ToRect(0.5)
 	}
 	return rect
 }
@@ -60,9 +73,12 @@ func (r *Record) Area() float64 {
 	return (r.MbrXMax - r.MbrXMin) * (r.MbrYMax - r.MbrYMin)
 }
 
+// Scanner reads records from an OS Open Names CSV file. Malformed records are skipped and
+// counted, see Skipped.
 type Scanner struct {
 	csvReader  *csv.Reader
 	nextRecord *Record
+	skipped    int
 	err        error
 }
 
@@ -72,7 +88,9 @@ func NewScanner(r io.Reader) (*Scanner, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Scanner{csvReader: csv.NewReader(br)}, nil
+	cr := csv.NewReader(br)
+	cr.FieldsPerRecord = -1 // field count is checked by parseRecord
+	return &Scanner{csvReader: cr}, nil
 }
 
 var BOM = [3]byte{0xef, 0xbb, 0xbf}
@@ -89,20 +107,32 @@ func skipBOM(br *bufio.Reader) error {
 }
 
 func (s *Scanner) Scan() bool {
-	rawRecord, err := s.csvReader.Read()
-	if err != nil {
-		if errors.Is(err, io.EOF) {
+	for {
+		rawRecord, err := s.csvReader.Read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return false
+			}
+			var perr *csv.ParseError
+			if errors.As(err, &perr) {
+				s.skipped++
+				continue
+			}
+			s.err = err
 			return false
 		}
-		s.err = err
-		return false
-	}
-	s.nextRecord, err = parseRecord(rawRecord)
-	if err != nil {
-		s.err = err
-		return false
+		s.nextRecord, err = parseRecord(rawRecord)
+		if err != nil {
+			s.skipped++
+			continue
+		}
+		return true
 	}
-	return true
+}
+
+// Skipped returns the number of malformed records skipped so far.
+func (s *Scanner) Skipped() int {
+	return s.skipped
 }
 
 func (s *Scanner) Err() error {
@@ -7,6 +7,8 @@ import (
 	"encoding/gob"
 	"errors"
 	"io"
+	"log"
+	"math"
 
 	"github.com/dhconnelly/rtreego"
 )
@@ -21,17 +23,31 @@ type NamedBoundary struct {
 	Ymax   float64
 }
 
+// Valid reports whether the boundary is a rectangle of positive area.
+func (b *NamedBoundary) Valid() bool {
+	for _, x := range []float64{b.Xmin, b.Ymin, b.Xmax, b.Ymax} {
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return false
+		}
+	}
+	return b.Xmax > b.Xmin && b.Ymax > b.Ymin
+}
+
+// Bounds returns the bounding rectangle of the place. An invalid boundary is treated as a
+// 1m square at its minimum corner.
 func (b *NamedBoundary) Bounds() *rtreego.Rect {
 	r, err := rtreego.NewRect(rtreego.Point{b.Xmin, b.Ymin}, []float64{b.Xmax - b.Xmin, b.Ymax - b.Ymin})
 	if err != nil {
-		panic(err)
+		return rtreego.Point{b.Xmin, b.Ymin}.ToRect(0.5)
 	}
 	return r
 }
 
+// NearEnough reports whether p lies within margin of the boundary. It is false for a nil
+// boundary or a point that is not 2-dimensional.
 func (b *NamedBoundary) NearEnough(p rtreego.Point, margin float64) bool {
-	if len(p) != 2 {
-		panic("Expected a 2-dimensional point")
+	if b == nil || len(p) != 2 {
+		return false
 	}
 	return p[0] >= b.Xmin-margin &&
 		p[0] <= b.Xmax+margin &&
@@ -39,21 +55,25 @@ func (b *NamedBoundary) NearEnough(p rtreego.Point, margin float64) bool {
 		p[1] <= b.Ymax+margin
 }
 
+// Contains reports whether p lies within the boundary. It is false for a nil boundary or a
+// point that is not 2-dimensional.
 func (b *NamedBoundary) Contains(p rtreego.Point) bool {
-	if len(p) != 2 {
-		panic("Expected a 2-dimensional point")
+	if b == nil || len(p) != 2 {
+		return false
 	}
 	return p[0] >= b.Xmin && p[0] <= b.Xmax && p[1] >= b.Ymin && p[1] <= b.Ymax
 }
 
-// Restore reads bounded places in gob format and constructs an RTree index
-func RestoreIndex() (*rtreego.Rtree, error) {
+// Boundaries reads the bounded places embedded in the binary in gob format. Places with
+// invalid boundaries are skipped.
+func Boundaries() ([]*NamedBoundary, error) {
 	data, err := dataResource()
 	if err != nil {
 		return nil, err
 	}
 	dec := gob.NewDecoder(bytes.NewReader(data))
-	var objs []rtreego.Spatial
+	var boundaries []*NamedBoundary
+	skipped := 0
 	for {
 		var b NamedBoundary
 		if err := dec.Decode(&b); err != nil {
@@ -62,7 +82,27 @@ func RestoreIndex() (*rtreego.Rtree, error) {
 			}
 			return nil, err
 		}
-		objs = append(objs, &b)
+		if !b.Valid() {
+			skipped++
+			continue
+		}
+		boundaries = append(boundaries, &b)
+	}
+	if skipped > 0 {
+		log.Printf("Skipped %d places with invalid boundaries", skipped)
+	}
+	return boundaries, nil
+}
+
+// Restore reads bounded places in gob format and constructs an RTree index
+func RestoreIndex() (*rtreego.Rtree, error) {
+	boundaries, err := Boundaries()
+	if err != nil {
+		return nil, err
+	}
+	objs := make([]rtreego.Spatial, len(boundaries))
+	for i, b := range boundaries {
+		objs[i] = b
 	}
 	rt := rtreego.NewTree(2, 25, 50, objs...)
 	return rt, nil
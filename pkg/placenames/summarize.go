@@ -1,10 +1,14 @@
 package placenames
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"math"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dhconnelly/rtreego"
@@ -28,6 +32,7 @@ type GPXSummarizerConfig struct {
 	PointOfInterestDuplicateDistance float64
 	PointOfInterestMinimumDistance   float64
 	MinimumSettlementRank            int
+	MaximumPoints                    int
 }
 
 var DefaultGPXSummarizerConfig = GPXSummarizerConfig{
@@ -36,15 +41,21 @@ var DefaultGPXSummarizerConfig = GPXSummarizerConfig{
 	PointOfInterestDuplicateDistance: 1.0,   // km
 	PointOfInterestMinimumDistance:   0.0,   // km
 	MinimumSettlementRank:            1,     // "Other Settlement"
+	MaximumPoints:                    0,     // no limit
 }
 
-type Option func(*GPXSummarizerConfig)
+// Option overrides a setting of GPXSummarizerConfig, returning an error if the value is invalid.
+type Option func(*GPXSummarizerConfig) error
 
 // WithCoffeeStopSearchRectangleSize overrides the size (in metres) of the rectangle searched
 // for coffee stops near the route. Default 500m.
 func WithCoffeeStopSearchRectangleSize(d float64) Option {
-	return func(c *GPXSummarizerConfig) {
+	return func(c *GPXSummarizerConfig) error {
+		if err := checkDistance("coffee stop search rectangle size", d); err != nil {
+			return err
+		}
 		c.CoffeeStopSearchRectangleSize = d
+		return nil
 	}
 }
 
@@ -52,16 +63,24 @@ func WithCoffeeStopSearchRectangleSize(d float64) Option {
 // route when suppressing duplicate coffee stop entries. This should be at least twice the
 // CoffeeStopSearchRectangleSize. Default 2km.
 func WithCoffeeStopDuplicateDistance(d float64) Option {
-	return func(c *GPXSummarizerConfig) {
+	return func(c *GPXSummarizerConfig) error {
+		if err := checkDistance("coffee stop duplicate distance", d); err != nil {
+			return err
+		}
 		c.CoffeeStopDuplicateDistance = d
+		return nil
 	}
 }
 
 // WithPointOfInterestDuplicateDistance overrides the distance (in km) we look back along
 // the route when suppressing duplicate points of interest.
 func WithPointOfInterestDuplicateDistance(d float64) Option {
-	return func(c *GPXSummarizerConfig) {
+	return func(c *GPXSummarizerConfig) error {
+		if err := checkDistance("point of interest duplicate distance", d); err != nil {
+			return err
+		}
 		c.PointOfInterestDuplicateDistance = d
+		return nil
 	}
 }
 
@@ -69,33 +88,105 @@ func WithPointOfInterestDuplicateDistance(d float64) Option {
 // of interest (if two POI appear within this distance, the second one is suppressed). Default
 // 0km (no suppression).
 func WithPointOfInterestMinimumDistance(d float64) Option {
-	return func(c *GPXSummarizerConfig) {
+	return func(c *GPXSummarizerConfig) error {
+		if err := checkDistance("point of interest minimum distance", d); err != nil {
+			return err
+		}
 		c.PointOfInterestMinimumDistance = d
+		return nil
 	}
 }
 
-func WithMinimumSettlement(s string) Option {
-	rank, ok := populatedPlaceRank[s]
-	if !ok {
-		panic(fmt.Sprintf("invalid settlement type: %s", s))
+// WithMaximumPoints limits the number of track points the summarizer will process; longer
+// tracks are rejected with ErrTooManyPoints. Default 0 (no limit).
+func WithMaximumPoints(n int) Option {
+	return func(c *GPXSummarizerConfig) error {
+		if n < 0 {
+			return fmt.Errorf("%w: maximum points %d is negative", ErrInvalidOption, n)
+		}
+		c.MaximumPoints = n
+		return nil
 	}
-	return func(c *GPXSummarizerConfig) {
+}
+
+// SettlementRank returns the rank of a populated place type, and false if the type is not
+// recognized.
+func SettlementRank(s string) (int, bool) {
+	rank, ok := populatedPlaceRank[s]
+	return rank, ok
+}
+
+// WithMinimumSettlement excludes populated places smaller than s (City, Town, Village, Hamlet
+// or Other Settlement) from the points of interest.
+func WithMinimumSettlement(s string) Option {
+	return func(c *GPXSummarizerConfig) error {
+		rank, ok := populatedPlaceRank[s]
+		if !ok {
+			return fmt.Errorf("%w: invalid settlement type %q (expected City, Town, Village, Hamlet or Other Settlement)", ErrInvalidOption, s)
+		}
 		c.MinimumSettlementRank = rank
+		return nil
+	}
+}
+
+var ErrInvalidOption = errors.New("invalid summarizer option")
+
+func checkDistance(name string, d float64) error {
+	if d < 0 || math.IsNaN(d) || math.IsInf(d, 0) {
+		return fmt.Errorf("%w: %s %g must be a non-negative number", ErrInvalidOption, name, d)
 	}
+	return nil
 }
 
+func applyOptions(conf *GPXSummarizerConfig, opts []Option) error {
+	for _, f := range opts {
+		if err := f(conf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GPXSummarizer is safe for concurrent use by multiple goroutines. Its place index,
+// coordinate transformer and configuration are never modified after construction,
+// SummarizeTrack keeps all per-track state in local variables, and the stops index passed
+// to SummarizeTrack is only read, so may be shared too.
 type GPXSummarizer struct {
 	poi   *rtreego.Rtree
 	trans osgb.CoordinateTransformer
 	conf  GPXSummarizerConfig
+	stats *summarizerStats
+}
+
+// SummarizerStats counts the tracks summarized, their points and the time taken.
+type SummarizerStats struct {
+	Tracks   uint64
+	Points   uint64
+	Duration time.Duration
+}
+
+type summarizerStats struct {
+	tracks uint64
+	points uint64
+	nanos  uint64
+}
+
+// Stats returns the work done so far by gs and the summarizers derived from it with
+// WithOptions. Only tracks summarized successfully are counted.
+func (gs *GPXSummarizer) Stats() SummarizerStats {
+	return SummarizerStats{
+		Tracks:   atomic.LoadUint64(&gs.stats.tracks),
+		Points:   atomic.LoadUint64(&gs.stats.points),
+		Duration: time.Duration(atomic.LoadUint64(&gs.stats.nanos)),
+	}
 }
 
 func NewGPXSummarizer(opts ...Option) (*GPXSummarizer, error) {
 	conf := DefaultGPXSummarizerConfig
-	for _, f := range opts {
-		f(&conf)
+	if err := applyOptions(&conf, opts); err != nil {
+		return nil, err
 	}
-	trans, err := osgb.NewOSTN15Transformer()
+	trans, err := nationalGridTransformer()
 	if err != nil {
 		return nil, err
 	}
@@ -103,7 +194,33 @@ func NewGPXSummarizer(opts ...Option) (*GPXSummarizer, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &GPXSummarizer{poi: rt, trans: trans, conf: conf}, nil
+	return &GPXSummarizer{poi: rt, trans: trans, conf: conf, stats: &summarizerStats{}}, nil
+}
+
+// WithOptions returns a summarizer that applies opts on top of the configuration of gs. It
+// shares the place index and coordinate transformer of gs, so is cheap to construct.
+func (gs *GPXSummarizer) WithOptions(opts ...Option) (*GPXSummarizer, error) {
+	conf := gs.conf
+	if err := applyOptions(&conf, opts); err != nil {
+		return nil, err
+	}
+	return &GPXSummarizer{poi: gs.poi, trans: gs.trans, conf: conf, stats: gs.stats}, nil
+}
+
+var (
+	transOnce sync.Once
+	trans     osgb.CoordinateTransformer
+	transErr  error
+)
+
+// nationalGridTransformer returns the coordinate transformer shared by all summarizers, as
+// it is expensive to construct. The OSTN15 transformer only reads its shift records after
+// construction, so it is safe for concurrent use.
+func nationalGridTransformer() (osgb.CoordinateTransformer, error) {
+	transOnce.Do(func() {
+		trans, transErr = osgb.NewOSTN15Transformer()
+	})
+	return trans, transErr
 }
 
 func distance(p1, p2 rtreego.Point) float64 {
@@ -118,12 +235,28 @@ func distance(p1, p2 rtreego.Point) float64 {
 	return math.Sqrt(s) / 1000.0
 }
 
+// POI is a place the route passes through. Easting and Northing locate the centre of the
+// place on the National Grid.
 type POI struct {
 	Name     string
 	Type     string
+	County   string  `json:",omitempty"`
+	Easting  float64 `json:",omitempty"`
+	Northing float64 `json:",omitempty"`
 	Distance float64
 }
 
+func newPOI(b *NamedBoundary, distance float64) POI {
+	return POI{
+		Name:     b.Name,
+		Type:     b.Type,
+		County:   b.County,
+		Easting:  (b.Xmin + b.Xmax) / 2,
+		Northing: (b.Ymin + b.Ymax) / 2,
+		Distance: distance,
+	}
+}
+
 type RefreshmentStop struct {
 	Name     string
 	Url      string
@@ -140,24 +273,58 @@ type TrackSummary struct {
 	Distance         float64
 	Ascent           float64
 	Descent          float64
+	ElapsedTime      float64 `json:",omitempty"` // hours, for tracks with timestamps
+	MovingTime       float64 `json:",omitempty"` // hours
+	AverageSpeed     float64 `json:",omitempty"` // km/h while moving
 	PointsOfInterest []POI
 	RefreshmentStops []RefreshmentStop `json:",omitempty"`
 	Counties         map[string]int
 }
 
+var (
+	ErrInvalidGPX    = errors.New("invalid GPX")
+	ErrEmptyTrack    = errors.New("track has no points")
+	ErrOutOfCoverage = errors.New("track outside the area covered by the place names data")
+	ErrTooManyPoints = errors.New("too many track points")
+)
+
+// How many points to process between checks for cancellation
+const cancelCheckInterval = 1000
+
+// Speed (km/h) below which the rider is treated as stopped when calculating moving time
+const movingSpeed = 3.0
+
+// SummarizeTrack reads a GPX document and summarizes its tracks. stops may be nil, in which
+// case no refreshment stops are reported.
 func (gs *GPXSummarizer) SummarizeTrack(r io.Reader, stops *rtreego.Rtree) (*TrackSummary, error) {
+	return gs.SummarizeTrackContext(context.Background(), r, stops)
+}
+
+// SummarizeTrackContext is like SummarizeTrack, but gives up with ctx.Err() when ctx is done.
+func (gs *GPXSummarizer) SummarizeTrackContext(ctx context.Context, r io.Reader, stops *rtreego.Rtree) (*TrackSummary, error) {
+	started := time.Now()
 	g, err := gpx.Read(r)
 	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidGPX, err)
+	}
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
+	if gs.conf.MaximumPoints > 0 {
+		if n := countPoints(g); n > gs.conf.MaximumPoints {
+			return nil, fmt.Errorf("%w: %d exceeds limit of %d", ErrTooManyPoints, n, gs.conf.MaximumPoints)
+		}
+	}
 	var s TrackSummary
-	s.Name = g.Metadata.Name
-	s.Time = g.Metadata.Time
 	s.Counties = make(map[string]int)
-	for _, l := range g.Metadata.Link {
-		if strings.HasPrefix(l.HREF, "http") {
-			s.Link = l.HREF
-			break
+	if g.Metadata != nil {
+		s.Name = g.Metadata.Name
+		s.Time = g.Metadata.Time
+		for _, l := range g.Metadata.Link {
+			if strings.HasPrefix(l.HREF, "http") {
+				s.Link = l.HREF
+				break
+			}
 		}
 	}
 
@@ -167,34 +334,56 @@ func (gs *GPXSummarizer) SummarizeTrack(r io.Reader, stops *rtreego.Rtree) (*Tra
 	var prevPoint rtreego.Point
 	var start rtreego.Point
 	var dN, dE float64
+	var startTime, prevTime time.Time
 
 	init := true
+	count := 0
 	for _, trk := range g.Trk {
 		for _, seg := range trk.TrkSeg {
 			for _, p := range seg.TrkPt {
+				count++
+				if count%cancelCheckInterval == 0 {
+					if err := ctx.Err(); err != nil {
+						return nil, err
+					}
+				}
 				gpsCoord := osgb.NewETRS89Coord(p.Lon, p.Lat, p.Ele)
 				ngCoord, err := gs.trans.ToNationalGrid(gpsCoord)
 				if err != nil {
-					return nil, err
+					return nil, fmt.Errorf("%w: %v", ErrOutOfCoverage, err)
 				}
 				elevations = append(elevations, p.Ele)
 				thisPoint := rtreego.Point{ngCoord.Easting, ngCoord.Northing}
 				nn, _ := gs.poi.NearestNeighbor(thisPoint).(*NamedBoundary)
 				if init {
 					if !nn.NearEnough(thisPoint, 500.0) {
-						return nil, fmt.Errorf("start point out of range")
+						return nil, fmt.Errorf("%w: no place near the start point", ErrOutOfCoverage)
 					}
 					start = thisPoint
 					s.Start = nn.Name
 					prevPlace = nn.Name
 					prevPlacePoint = thisPoint
 					prevPoint = thisPoint
-					s.PointsOfInterest = append(s.PointsOfInterest, POI{Name: nn.Name, Type: nn.Type, Distance: 0.0})
+					s.PointsOfInterest = append(s.PointsOfInterest, newPOI(nn, 0.0))
 					s.Counties[nn.County]++
+					startTime = p.Time
+					prevTime = p.Time
 					init = false
 					continue
 				}
-				s.Distance += distance(thisPoint, prevPoint)
+				d := distance(thisPoint, prevPoint)
+				s.Distance += d
+				if !p.Time.IsZero() {
+					if !prevTime.IsZero() {
+						if dt := p.Time.Sub(prevTime).Hours(); dt > 0 && d/dt >= movingSpeed {
+							s.MovingTime += dt
+						}
+					}
+					if startTime.IsZero() {
+						startTime = p.Time
+					}
+					prevTime = p.Time
+				}
 				dE += thisPoint[0] - start[0]
 				dN += thisPoint[1] - start[1]
 				if nn.Contains(thisPoint) && populatedPlaceRank[nn.Type] >= gs.conf.MinimumSettlementRank {
@@ -210,7 +399,7 @@ func (gs *GPXSummarizer) SummarizeTrack(r io.Reader, stops *rtreego.Rtree) (*Tra
 						}
 					}
 					if !seenRecently && distance(thisPoint, prevPlacePoint) > gs.conf.PointOfInterestMinimumDistance {
-						s.PointsOfInterest = append(s.PointsOfInterest, POI{Name: nn.Name, Type: nn.Type, Distance: s.Distance})
+						s.PointsOfInterest = append(s.PointsOfInterest, newPOI(nn, s.Distance))
 						prevPlace = nn.Name
 						prevPlacePoint = thisPoint
 					}
@@ -241,13 +430,35 @@ func (gs *GPXSummarizer) SummarizeTrack(r io.Reader, stops *rtreego.Rtree) (*Tra
 			}
 		}
 	}
+	if init {
+		return nil, ErrEmptyTrack
+	}
 	s.Finish = prevPlace
+	if !startTime.IsZero() && prevTime.After(startTime) {
+		s.ElapsedTime = prevTime.Sub(startTime).Hours()
+		if s.MovingTime > 0 {
+			s.AverageSpeed = s.Distance / s.MovingTime
+		}
+	}
 	s.Direction = calcDirection(dE, dN)
 	s.Ascent, s.Descent = calcUphillDownhill(elevations)
 	s.Counties = toPercentages(s.Counties)
+	atomic.AddUint64(&gs.stats.tracks, 1)
+	atomic.AddUint64(&gs.stats.points, uint64(count))
+	atomic.AddUint64(&gs.stats.nanos, uint64(time.Since(started)))
 	return &s, nil
 }
 
+func countPoints(g *gpx.GPX) int {
+	n := 0
+	for _, trk := range g.Trk {
+		for _, seg := range trk.TrkSeg {
+			n += len(seg.TrkPt)
+		}
+	}
+	return n
+}
+
 func toPercentages(m map[string]int) map[string]int {
 	t := 0
 	for _, v := range m {
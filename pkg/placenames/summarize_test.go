@@ -0,0 +1,270 @@
+package placenames
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dhconnelly/rtreego"
+	"github.com/ray1729/gpx-utils/pkg/cafes"
+)
+
+// The summarizer takes a couple of seconds to load its place index, so the tests share one.
+var (
+	testSummarizer     *GPXSummarizer
+	testSummarizerErr  error
+	testSummarizerOnce sync.Once
+)
+
+func summarizer(tb testing.TB) *GPXSummarizer {
+	tb.Helper()
+	testSummarizerOnce.Do(func() {
+		testSummarizer, testSummarizerErr = NewGPXSummarizer()
+	})
+	if testSummarizerErr != nil {
+		tb.Fatalf("error creating summarizer: %v", testSummarizerErr)
+	}
+	return testSummarizer
+}
+
+// testStops returns an index of refreshment stops along the fixture tracks, read from a
+// waypoints file in the format published by CTC Cambridge.
+func testStops(tb testing.TB) *rtreego.Rtree {
+	tb.Helper()
+	f, err := os.Open(filepath.Join("testdata", "stops.xml"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer f.Close()
+	stops, err := cafes.BuildCtcCamIndex(f)
+	if err != nil {
+		tb.Fatalf("error building stops index: %v", err)
+	}
+	return stops
+}
+
+// fixtures returns the contents of the GPX files in testdata, keyed by file name.
+func fixtures(tb testing.TB) map[string][]byte {
+	tb.Helper()
+	filenames, err := filepath.Glob(filepath.Join("testdata", "*.gpx"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if len(filenames) == 0 {
+		tb.Fatal("no GPX fixtures in testdata")
+	}
+	tracks := make(map[string][]byte)
+	for _, filename := range filenames {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		tracks[filepath.Base(filename)] = data
+	}
+	return tracks
+}
+
+func TestSummarizeTrack(t *testing.T) {
+	gs := summarizer(t)
+	tracks := fixtures(t)
+	tests := []struct {
+		file      string
+		name      string
+		start     string
+		finish    string
+		distance  float64
+		via       []string
+		counties  []string
+		hasTiming bool
+	}{
+		{
+			file:      "fens-loop.gpx",
+			name:      "Fens Loop",
+			start:     "Cambridge",
+			finish:    "Cambridge",
+			distance:  34,
+			via:       []string{"Histon", "Cottenham", "Waterbeach", "Bottisham", "Fulbourn"},
+			counties:  []string{"Cambridgeshire"},
+			hasTiming: true,
+		},
+		{
+			file:     "saffron-walden.gpx",
+			name:     "Cambridge to Saffron Walden",
+			start:    "Cambridge",
+			finish:   "Saffron Walden",
+			distance: 22.5,
+			via:      []string{"Great Shelford", "Sawston", "Great Chesterford"},
+			counties: []string{"Cambridgeshire", "Essex"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.file, func(t *testing.T) {
+			s, err := gs.SummarizeTrack(bytes.NewReader(tracks[tc.file]), nil)
+			if err != nil {
+				t.Fatalf("SummarizeTrack: %v", err)
+			}
+			if s.Name != tc.name || s.Start != tc.start || s.Finish != tc.finish {
+				t.Errorf("got name %q from %q to %q, want %q from %q to %q", s.Name, s.Start, s.Finish, tc.name, tc.start, tc.finish)
+			}
+			if d := s.Distance - tc.distance; d < -0.5 || d > 0.5 {
+				t.Errorf("got distance %.2f km, want %.1f km", s.Distance, tc.distance)
+			}
+			var pois []string
+			for _, p := range s.PointsOfInterest {
+				pois = append(pois, p.Name)
+			}
+			for _, v := range tc.via {
+				if !contains(pois, v) {
+					t.Errorf("points of interest %v do not include %s", pois, v)
+				}
+			}
+			for _, c := range tc.counties {
+				if s.Counties[c] == 0 {
+					t.Errorf("counties %v do not include %s", s.Counties, c)
+				}
+			}
+			if got := s.MovingTime > 0; got != tc.hasTiming {
+				t.Errorf("got moving time %.2f h, want timing %v", s.MovingTime, tc.hasTiming)
+			}
+		})
+	}
+}
+
+func TestSummarizeTrackErrors(t *testing.T) {
+	gs := summarizer(t)
+	tests := []struct {
+		name string
+		gpx  string
+		want error
+	}{
+		{"empty", `<gpx version="1.1" xmlns="http://www.topografix.com/GPX/1/1"><trk><trkseg></trkseg></trk></gpx>`, ErrEmptyTrack},
+		{"invalid", `not GPX`, ErrInvalidGPX},
+		{"outside coverage", `<gpx version="1.1" xmlns="http://www.topografix.com/GPX/1/1"><trk><trkseg>` +
+			`<trkpt lat="48.8566" lon="2.3522"></trkpt><trkpt lat="48.8570" lon="2.3530"></trkpt></trkseg></trk></gpx>`, ErrOutOfCoverage},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := gs.SummarizeTrack(strings.NewReader(tc.gpx), nil)
+			if !errors.Is(err, tc.want) {
+				t.Errorf("got error %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+// TestSummarizeTrackConcurrent checks that a GPXSummarizer shared between goroutines gives
+// the same results as when it is used serially. Run it with -race to check for data races.
+func TestSummarizeTrackConcurrent(t *testing.T) {
+	gs := summarizer(t)
+	tracks := fixtures(t)
+	stops := testStops(t)
+	var names []string
+	expected := make(map[string]*TrackSummary)
+	for name, data := range tracks {
+		s, err := gs.SummarizeTrack(bytes.NewReader(data), stops)
+		if err != nil {
+			t.Fatalf("error summarizing %s: %v", name, err)
+		}
+		if len(s.RefreshmentStops) == 0 {
+			t.Fatalf("no refreshment stops found on %s", name)
+		}
+		names = append(names, name)
+		expected[name] = s
+	}
+	workers := 4 * runtime.GOMAXPROCS(0)
+	iterations := 5
+	if testing.Short() {
+		iterations = 1
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*iterations*len(names))
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; n < iterations; n++ {
+				// Each goroutine takes the tracks in a different order
+				name := names[(i+n)%len(names)]
+				s, err := gs.SummarizeTrack(bytes.NewReader(tracks[name]), stops)
+				if err != nil {
+					errs <- err
+					continue
+				}
+				if !reflect.DeepEqual(s, expected[name]) {
+					errs <- &mismatchError{name}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+type mismatchError struct {
+	name string
+}
+
+func (e *mismatchError) Error() string {
+	return "concurrent summary of " + e.name + " differs from serial summary"
+}
+
+func BenchmarkSummarizeTrack(b *testing.B) {
+	gs := summarizer(b)
+	tracks := fixtures(b)
+	for name, data := range tracks {
+		points := fixturePoints(data)
+		b.Run(strings.TrimSuffix(name, ".gpx"), func(b *testing.B) {
+			b.ReportAllocs()
+			started := time.Now()
+			for i := 0; i < b.N; i++ {
+				if _, err := gs.SummarizeTrack(bytes.NewReader(data), nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(points*b.N)/time.Since(started).Seconds(), "points/s")
+		})
+	}
+}
+
+func BenchmarkSummarizeTrackParallel(b *testing.B) {
+	gs := summarizer(b)
+	data := fixtures(b)["fens-loop.gpx"]
+	stops := testStops(b)
+	points := fixturePoints(data)
+	b.ReportAllocs()
+	b.ResetTimer()
+	started := time.Now()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := gs.SummarizeTrack(bytes.NewReader(data), stops); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+	b.ReportMetric(float64(points*b.N)/time.Since(started).Seconds(), "points/s")
+}
+
+func fixturePoints(data []byte) int {
+	return bytes.Count(data, []byte("<trkpt "))
+}
+
+func contains(items []string, s string) bool {
+	for _, v := range items {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,39 @@
+// Package requestid carries the ID the server gives each HTTP request in the request context,
+// so that messages logged while handling a request can be matched with its access log entry.
+package requestid
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying the request ID id.
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the request ID carried by ctx, or "" if there is none.
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// Printf logs a message like log.Printf, prefixed with the request ID carried by ctx.
+func Printf(ctx context.Context, format string, v ...interface{}) {
+	log.Print(prefix(ctx) + fmt.Sprintf(format, v...))
+}
+
+// Println logs a message like log.Println, prefixed with the request ID carried by ctx.
+func Println(ctx context.Context, v ...interface{}) {
+	log.Print(prefix(ctx) + fmt.Sprintln(v...))
+}
+
+func prefix(ctx context.Context) string {
+	if id := FromContext(ctx); id != "" {
+		return "[" + id + "] "
+	}
+	return ""
+}
@@ -0,0 +1,341 @@
+package rwgps
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ray1729/gpx-utils/pkg/placenames"
+)
+
+// CacheStatus reports how a cached value was obtained.
+type CacheStatus string
+
+const (
+	CacheHit         CacheStatus = "HIT"         // served from the cache
+	CacheMiss        CacheStatus = "MISS"        // fetched from RideWithGPS
+	CacheRevalidated CacheStatus = "REVALIDATED" // RideWithGPS confirmed the cached route is unchanged
+)
+
+// CacheStats counts the requests served by a RouteCache.
+type CacheStats struct {
+	Hits          uint64
+	Misses        uint64
+	Revalidations uint64
+	Errors        uint64
+}
+
+// RouteCache caches routes fetched from RideWithGPS and their summaries. Routes older than
+// the TTL are revalidated with a conditional request. If dir is not empty, routes are also
+// stored on disk so they survive a restart. As with cafes.Cache, concurrent requests for the
+// same route share a single fetch.
+type RouteCache struct {
+	client    *Client
+	ttl       time.Duration
+	dir       string
+	tracks    flightCache
+	summaries flightCache
+	stats     CacheStats
+}
+
+func NewRouteCache(client *Client, ttl time.Duration, dir string) (*RouteCache, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("error creating cache directory %s: %v", dir, err)
+		}
+	}
+	return &RouteCache{client: client, ttl: ttl, dir: dir}, nil
+}
+
+// Stats returns the number of hits, misses, revalidations and errors so far.
+func (c *RouteCache) Stats() CacheStats {
+	return CacheStats{
+		Hits:          atomic.LoadUint64(&c.stats.Hits),
+		Misses:        atomic.LoadUint64(&c.stats.Misses),
+		Revalidations: atomic.LoadUint64(&c.stats.Revalidations),
+		Errors:        atomic.LoadUint64(&c.stats.Errors),
+	}
+}
+
+func (c *RouteCache) count(status CacheStatus) {
+	switch status {
+	case CacheHit:
+		atomic.AddUint64(&c.stats.Hits, 1)
+	case CacheRevalidated:
+		atomic.AddUint64(&c.stats.Revalidations, 1)
+	default:
+		atomic.AddUint64(&c.stats.Misses, 1)
+	}
+}
+
+// SummarizeFunc summarizes a route in GPX format.
+type SummarizeFunc func(ctx context.Context, track []byte) (*placenames.TrackSummary, error)
+
+// Summary returns the summary of a route or trip. key identifies the summary options, so
+// summaries made with different options are cached separately.
+func (c *RouteCache) Summary(ctx context.Context, ref Ref, key string, summarize SummarizeFunc) (*placenames.TrackSummary, CacheStatus, error) {
+	track, trackStatus, err := c.track(ctx, ref)
+	if err != nil {
+		atomic.AddUint64(&c.stats.Errors, 1)
+		return nil, "", err
+	}
+	summaryKey := fmt.Sprintf("%s/%s/%s", refKey(ref), trackVersion(track), key)
+	v, summaryStatus, err := c.summaries.get(ctx, summaryKey, c.ttl, func(ctx context.Context, _ interface{}) (interface{}, CacheStatus, error) {
+		s, err := summarize(ctx, track.Data)
+		return s, CacheMiss, err
+	})
+	if err != nil {
+		atomic.AddUint64(&c.stats.Errors, 1)
+		return nil, "", err
+	}
+	status := trackStatus
+	if trackStatus == CacheHit && summaryStatus != CacheHit {
+		// The route was cached, but not summarized with these options
+		status = CacheMiss
+	}
+	c.count(status)
+	return v.(*placenames.TrackSummary), status, nil
+}
+
+// Track returns a route or trip in GPX format.
+func (c *RouteCache) Track(ctx context.Context, ref Ref) ([]byte, CacheStatus, error) {
+	t, status, err := c.track(ctx, ref)
+	if err != nil {
+		atomic.AddUint64(&c.stats.Errors, 1)
+		return nil, "", err
+	}
+	c.count(status)
+	return t.Data, status, nil
+}
+
+// Expire marks a cached route or trip as stale, so that it is revalidated the next time it
+// is requested.
+func (c *RouteCache) Expire(ref Ref) {
+	c.tracks.expire(refKey(ref))
+	if c.dir == "" {
+		return
+	}
+	t, err := c.readTrack(ref)
+	if err != nil || t == nil {
+		return
+	}
+	t.Fetched = time.Time{}
+	if err := c.writeTrack(ref, t, false); err != nil {
+		log.Printf("Error expiring cached %s: %v", ref, err)
+	}
+}
+
+func (c *RouteCache) track(ctx context.Context, ref Ref) (*Track, CacheStatus, error) {
+	v, status, err := c.tracks.get(ctx, refKey(ref), c.ttl, func(ctx context.Context, prev interface{}) (interface{}, CacheStatus, error) {
+		prevTrack, _ := prev.(*Track)
+		return c.fetchTrack(ctx, ref, prevTrack)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return v.(*Track), status, nil
+}
+
+// fetchTrack fetches a route or trip, revalidating prev or the copy on disk if there is one.
+func (c *RouteCache) fetchTrack(ctx context.Context, ref Ref, prev *Track) (*Track, CacheStatus, error) {
+	if prev == nil && c.dir != "" {
+		t, err := c.readTrack(ref)
+		if err != nil {
+			log.Printf("Error reading cached %s: %v", ref, err)
+		}
+		if t != nil && time.Since(t.Fetched) < c.ttl {
+			return t, CacheHit, nil
+		}
+		prev = t
+	}
+	t, modified, err := c.client.RevalidateTrack(ctx, ref, prev)
+	if err != nil {
+		return nil, "", err
+	}
+	if c.dir != "" {
+		if err := c.writeTrack(ref, t, modified); err != nil {
+			log.Printf("Error caching %s: %v", ref, err)
+		}
+	}
+	if !modified {
+		return t, CacheRevalidated, nil
+	}
+	return t, CacheMiss, nil
+}
+
+// trackMeta is stored on disk alongside a cached route.
+type trackMeta struct {
+	ETag         string
+	LastModified string
+	Fetched      time.Time
+}
+
+// refKey identifies ref in the cache. A track fetched with a privacy code is cached apart
+// from one fetched without, under a hash of the code so that the code itself is not stored.
+func refKey(ref Ref) string {
+	if ref.PrivacyCode == "" {
+		return ref.String()
+	}
+	sum := sha256.Sum256([]byte(ref.PrivacyCode))
+	return ref.String() + "-" + hex.EncodeToString(sum[:8])
+}
+
+// trackPath returns the name of the file caching ref, e.g. routes-123.gpx.
+func (c *RouteCache) trackPath(ref Ref, ext string) string {
+	name := strings.Replace(refKey(ref), "/", "-", 1)
+	return filepath.Join(c.dir, name+"."+ext)
+}
+
+// readTrack reads a route or trip from disk, returning nil if it is not cached.
+func (c *RouteCache) readTrack(ref Ref) (*Track, error) {
+	rawMeta, err := ioutil.ReadFile(c.trackPath(ref, "json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var meta trackMeta
+	if err := json.Unmarshal(rawMeta, &meta); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(c.trackPath(ref, "gpx"))
+	if err != nil {
+		return nil, err
+	}
+	return &Track{Data: data, ETag: meta.ETag, LastModified: meta.LastModified, Fetched: meta.Fetched}, nil
+}
+
+// writeTrack stores a route or trip on disk. Unless it was modified, only its metadata is written.
+func (c *RouteCache) writeTrack(ref Ref, t *Track, modified bool) error {
+	if modified {
+		if err := writeFileAtomic(c.trackPath(ref, "gpx"), t.Data); err != nil {
+			return err
+		}
+	}
+	rawMeta, err := json.Marshal(trackMeta{ETag: t.ETag, LastModified: t.LastModified, Fetched: t.Fetched})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.trackPath(ref, "json"), rawMeta)
+}
+
+func writeFileAtomic(filename string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// trackVersion identifies the content of a route, so summaries of a route that has changed
+// are not reused.
+func trackVersion(t *Track) string {
+	sum := sha256.Sum256(t.Data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// flightCache is a TTL cache in which concurrent requests for a key share one call to fetch.
+// Errors are not cached.
+type flightCache struct {
+	mu      sync.Mutex
+	entries map[string]*flightEntry
+}
+
+type flightEntry struct {
+	value   interface{}
+	status  CacheStatus
+	err     error
+	filled  bool // guarded by flightCache.mu
+	expires time.Time
+	ready   chan struct{} // closed when value is ready
+}
+
+// fetchFunc obtains the value for a key. prev is the expired value, if any, which may be
+// revalidated.
+type fetchFunc func(ctx context.Context, prev interface{}) (interface{}, CacheStatus, error)
+
+func (c *flightCache) get(ctx context.Context, k string, ttl time.Duration, fetch fetchFunc) (interface{}, CacheStatus, error) {
+	c.mu.Lock()
+	if c.entries == nil {
+		c.entries = make(map[string]*flightEntry)
+	}
+	e := c.entries[k]
+	status := CacheHit
+	if e == nil || (e.filled && time.Now().After(e.expires)) {
+		var prev interface{}
+		if e != nil {
+			prev = e.value
+		}
+		c.purge(ttl)
+		e = &flightEntry{ready: make(chan struct{})}
+		c.entries[k] = e
+		c.mu.Unlock()
+		go c.fill(k, e, ttl, prev, fetch)
+		status = ""
+	} else {
+		c.mu.Unlock()
+	}
+	select {
+	case <-e.ready:
+		if status == "" {
+			status = e.status
+		}
+		return e.value, status, e.err
+	case <-ctx.Done():
+		return nil, "", ctx.Err()
+	}
+}
+
+// fill calls fetch for an entry. Waiting callers may give up, so fetch is not cancelled with
+// their context, and must bound its own running time.
+func (c *flightCache) fill(k string, e *flightEntry, ttl time.Duration, prev interface{}, fetch fetchFunc) {
+	value, status, err := fetch(context.Background(), prev)
+	c.mu.Lock()
+	e.value, e.status, e.err = value, status, err
+	e.filled = true
+	e.expires = time.Now().Add(ttl)
+	if err != nil && c.entries[k] == e {
+		delete(c.entries, k)
+	}
+	c.mu.Unlock()
+	close(e.ready)
+}
+
+// expire makes the value of k, if it is ready, expire now.
+func (c *flightCache) expire(k string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e := c.entries[k]; e != nil && e.filled {
+		e.expires = time.Now()
+	}
+}
+
+// purge removes entries that expired more than ttl ago. It must be called with c.mu held.
+func (c *flightCache) purge(ttl time.Duration) {
+	cutoff := time.Now().Add(-ttl)
+	for k, e := range c.entries {
+		if e.filled && e.expires.Before(cutoff) {
+			delete(c.entries, k)
+		}
+	}
+}
@@ -2,89 +2,450 @@ package rwgps
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/dhconnelly/rtreego"
 
 	"github.com/ray1729/gpx-utils/pkg/cafes"
 	"github.com/ray1729/gpx-utils/pkg/placenames"
+	"github.com/ray1729/gpx-utils/pkg/requestid"
+	"github.com/ray1729/gpx-utils/pkg/sources"
 )
 
 type RWGPSHandler struct {
-	gs    *placenames.GPXSummarizer
-	stops *cafes.Cache
+	gs      *placenames.GPXSummarizer
+	stops   *cafes.Cache
+	client  *Client
+	cache   *RouteCache
+	sources *sources.Registry
+	conf    HandlerConfig
 }
 
-func NewHandler() (*RWGPSHandler, error) {
-	gs, err := placenames.NewGPXSummarizer()
+// ErrInvalidRequest is returned by Track and Summary when the route parameters are missing or
+// invalid.
+var ErrInvalidRequest = errors.New("invalid request")
+
+// requestError is an ErrInvalidRequest that reads as its cause.
+type requestError struct {
+	err error
+}
+
+func (e *requestError) Error() string {
+	return e.err.Error()
+}
+
+func (e *requestError) Is(target error) bool {
+	return target == ErrInvalidRequest
+}
+
+func (e *requestError) Unwrap() error {
+	return e.err
+}
+
+// HandlerConfig holds the limits applied by the handler to each request.
+type HandlerConfig struct {
+	Timeout      time.Duration // time allowed to fetch and summarize a route, 0 for no limit
+	FetchTimeout time.Duration // time allowed to fetch a route from RideWithGPS
+	MaxSize      int64         // maximum size (in bytes) of a GPX track
+	MaxPoints    int           // maximum number of points in a track
+	CacheTTL     time.Duration // time routes and summaries are cached, 0 to disable caching
+	CacheDir     string        // directory to store cached routes, empty to cache in memory only
+	BaseURL      string        // RideWithGPS site, empty for DefaultBaseURL
+	APIKey       string        // RideWithGPS API key, needed for private routes
+	AuthToken    string        // RideWithGPS auth token of the user whose private routes we fetch
+	// SummarizerOptions are the server-wide defaults, which query parameters may override.
+	SummarizerOptions []placenames.Option
+	// Sources are the route sources other than RideWithGPS, selected by the source parameter.
+	Sources *sources.Registry
+	// Transport sends requests to RideWithGPS and watcher callbacks, nil for http.DefaultTransport.
+	Transport http.RoundTripper
+}
+
+var DefaultHandlerConfig = HandlerConfig{
+	Timeout:      60 * time.Second,
+	FetchTimeout: 30 * time.Second,
+	MaxSize:      10 << 20,
+	MaxPoints:    100000,
+	CacheTTL:     time.Hour,
+}
+
+type HandlerOption func(*HandlerConfig)
+
+// WithTimeout overrides the time allowed to handle a request. Default 60s.
+func WithTimeout(d time.Duration) HandlerOption {
+	return func(c *HandlerConfig) {
+		c.Timeout = d
+	}
+}
+
+// WithFetchTimeout overrides the time allowed to fetch a route. Default 30s.
+func WithFetchTimeout(d time.Duration) HandlerOption {
+	return func(c *HandlerConfig) {
+		c.FetchTimeout = d
+	}
+}
+
+// WithMaxSize overrides the maximum size (in bytes) of a GPX track. Default 10MiB.
+func WithMaxSize(n int64) HandlerOption {
+	return func(c *HandlerConfig) {
+		c.MaxSize = n
+	}
+}
+
+// WithMaxPoints overrides the maximum number of points in a track. Default 100000.
+func WithMaxPoints(n int) HandlerOption {
+	return func(c *HandlerConfig) {
+		c.MaxPoints = n
+	}
+}
+
+// WithCache overrides the time routes and their summaries are cached (default 1h, 0 disables
+// caching) and the directory where routes are stored (default none).
+func WithCache(ttl time.Duration, dir string) HandlerOption {
+	return func(c *HandlerConfig) {
+		c.CacheTTL = ttl
+		c.CacheDir = dir
+	}
+}
+
+// WithRWGPS overrides the RideWithGPS site and sets the credentials used to fetch private and
+// club routes. Empty values leave the corresponding setting unchanged.
+func WithRWGPS(baseURL, apiKey, authToken string) HandlerOption {
+	return func(c *HandlerConfig) {
+		if baseURL != "" {
+			c.BaseURL = baseURL
+		}
+		if apiKey != "" {
+			c.APIKey = apiKey
+		}
+		if authToken != "" {
+			c.AuthToken = authToken
+		}
+	}
+}
+
+// WithSources sets the route sources other than RideWithGPS. Default none.
+func WithSources(r *sources.Registry) HandlerOption {
+	return func(c *HandlerConfig) {
+		c.Sources = r
+	}
+}
+
+// WithTransport sets the transport used for requests to RideWithGPS and watcher callbacks,
+// for example to record their latency. Default http.DefaultTransport.
+func WithTransport(t http.RoundTripper) HandlerOption {
+	return func(c *HandlerConfig) {
+		c.Transport = t
+	}
+}
+
+// WithSummarizerOptions sets the server-wide defaults for the summarizer.
+func WithSummarizerOptions(opts ...placenames.Option) HandlerOption {
+	return func(c *HandlerConfig) {
+		c.SummarizerOptions = append(c.SummarizerOptions, opts...)
+	}
+}
+
+func NewHandler(opts ...HandlerOption) (*RWGPSHandler, error) {
+	conf := DefaultHandlerConfig
+	for _, f := range opts {
+		f(&conf)
+	}
+	gsOpts := append([]placenames.Option{placenames.WithMaximumPoints(conf.MaxPoints)}, conf.SummarizerOptions...)
+	gs, err := placenames.NewGPXSummarizer(gsOpts...)
 	if err != nil {
 		return nil, fmt.Errorf("error creating GPX summarizer: %v", err)
 	}
 	stops := cafes.New()
-	return &RWGPSHandler{gs, stops}, nil
+	client := &Client{
+		HTTPClient: &http.Client{Timeout: conf.FetchTimeout, Transport: conf.Transport},
+		BaseURL:    conf.BaseURL,
+		APIKey:     conf.APIKey,
+		AuthToken:  conf.AuthToken,
+		MaxSize:    conf.MaxSize,
+	}
+	h := &RWGPSHandler{gs: gs, stops: stops, client: client, sources: conf.Sources, conf: conf}
+	if conf.CacheTTL > 0 {
+		h.cache, err = NewRouteCache(client, conf.CacheTTL, conf.CacheDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// CacheStats returns the route cache statistics, or zero if caching is disabled.
+func (h *RWGPSHandler) CacheStats() CacheStats {
+	if h.cache == nil {
+		return CacheStats{}
+	}
+	return h.cache.Stats()
+}
+
+// StopsStats returns the refreshment stops cache statistics.
+func (h *RWGPSHandler) StopsStats() cafes.CacheStats {
+	return h.stops.Stats()
+}
+
+// SummarizerStats returns the work done by the handler's summarizer.
+func (h *RWGPSHandler) SummarizerStats() placenames.SummarizerStats {
+	return h.gs.Stats()
 }
 
 func (h *RWGPSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query()
-	rawRouteId := q.Get("routeId")
-	stopsName := q.Get("stops")
-	log.Printf("Handling request for routeId=%s stops=%s", rawRouteId, stopsName)
-	if rawRouteId == "" {
-		log.Printf("Missing routeId")
-		http.Error(w, "routeId is required", http.StatusBadRequest)
+	ctx := r.Context()
+	if h.conf.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.conf.Timeout)
+		defer cancel()
+	}
+	summary, status, err := h.Summary(ctx, q)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
-	routeId, err := strconv.Atoi(rawRouteId)
+	if status != "" {
+		w.Header().Set("X-Cache", string(status))
+	}
+	result, err := json.Marshal(summary)
 	if err != nil {
-		log.Printf("Error parsing route id '%s': %v", rawRouteId, err)
-		http.Error(w, fmt.Sprintf("Invalid routeId: %s", rawRouteId), http.StatusBadRequest)
+		requestid.Printf(ctx, "Error marshalling JSON: %v", err)
+		writeError(w, err)
 		return
 	}
-	var stopsIndex *rtreego.Rtree
-	if stopsName != "" {
-		var err error
-		stopsIndex, err = h.stops.Get(stopsName)
-		if err != nil {
-			log.Println(err)
-			if errors.Is(err, cafes.ErrInvalidStops) {
-				http.Error(w, err.Error(), http.StatusBadRequest)
-			} else {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-			}
-			return
-		}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(result)
+}
+
+// Summary fetches and summarizes the route identified by q, which takes the same parameters
+// as ServeHTTP. Summaries of routes from RideWithGPS are cached, and the status reports
+// whether this one came from the cache; it is empty if the route was not cached.
+func (h *RWGPSHandler) Summary(ctx context.Context, q url.Values) (*placenames.TrackSummary, CacheStatus, error) {
+	stopsName := q.Get("stops")
+	t, err := h.parseTarget(q)
+	if err != nil {
+		requestid.Println(ctx, err)
+		return nil, "", &requestError{err}
+	}
+	requestid.Printf(ctx, "Handling request for %s stops=%s", t, stopsName)
+	gs, err := h.summarizer(q)
+	if err != nil {
+		requestid.Println(ctx, err)
+		return nil, "", err
 	}
-	track, err := FetchTrack(routeId)
+	stopsIndex, err := h.stopsIndex(ctx, stopsName)
 	if err != nil {
-		log.Println(err.Error())
-		switch err.(type) {
-		case *ErrNotFound:
-			http.Error(w, err.Error(), http.StatusNotFound)
-		case *ErrNotPublic:
-			http.Error(w, err.Error(), http.StatusForbidden)
-		default:
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		requestid.Println(ctx, err)
+		return nil, "", err
+	}
+	summarize := func(ctx context.Context, track []byte) (*placenames.TrackSummary, error) {
+		if h.conf.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, h.conf.Timeout)
+			defer cancel()
+		}
+		return gs.SummarizeTrackContext(ctx, bytes.NewReader(track), stopsIndex)
+	}
+	var summary *placenames.TrackSummary
+	var status CacheStatus
+	switch {
+	case t.source != nil:
+		var track []byte
+		track, err = t.source.FetchGPX(ctx, t.id)
+		if err == nil {
+			summary, err = summarize(ctx, track)
+		}
+	case h.cache != nil:
+		summary, status, err = h.cache.Summary(ctx, t.ref, summaryKey(q), summarize)
+		if err == nil {
+			requestid.Printf(ctx, "Cache %s for %s", status, t)
+		}
+	default:
+		var track []byte
+		track, err = h.client.FetchRef(ctx, t.ref)
+		if err == nil {
+			summary, err = summarize(ctx, track)
 		}
-		return
 	}
-	summary, err := h.gs.SummarizeTrack(bytes.NewReader(track), stopsIndex)
 	if err != nil {
-		log.Printf("Error analyzing route %d: %v", routeId, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		requestid.Printf(ctx, "Error analyzing %s: %v", t, err)
+		return nil, "", err
 	}
-	result, err := json.Marshal(summary)
+	return summary, status, nil
+}
+
+// Link returns the web page of the route identified by q, or "" if it has none.
+func (h *RWGPSHandler) Link(q url.Values) string {
+	t, err := h.parseTarget(q)
 	if err != nil {
-		log.Printf("Error marshalling JSON for route %d: %v", routeId, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return ""
+	}
+	if t.source != nil {
+		return q.Get("url")
+	}
+	baseURL := h.conf.BaseURL
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	return strings.TrimRight(baseURL, "/") + "/" + t.ref.Path()
+}
+
+// Private reports whether the route identified by q is a RideWithGPS route or trip that can
+// only be seen with its privacy code.
+func (h *RWGPSHandler) Private(q url.Values) bool {
+	t, err := h.parseTarget(q)
+	return err == nil && t.source == nil && t.ref.PrivacyCode != ""
+}
+
+// Config returns the handler's configuration.
+func (h *RWGPSHandler) Config() HandlerConfig {
+	return h.conf
+}
+
+// Track fetches the GPX of the route identified by q, which takes the same parameters as
+// ServeHTTP. Routes from RideWithGPS are cached.
+func (h *RWGPSHandler) Track(ctx context.Context, q url.Values) ([]byte, error) {
+	t, err := h.parseTarget(q)
+	if err != nil {
+		return nil, &requestError{err}
+	}
+	switch {
+	case t.source != nil:
+		return t.source.FetchGPX(ctx, t.id)
+	case h.cache != nil:
+		track, _, err := h.cache.Track(ctx, t.ref)
+		return track, err
+	default:
+		return h.client.FetchRef(ctx, t.ref)
+	}
+}
+
+// Summarize summarizes a GPX track with the stops and tuning parameters in q.
+func (h *RWGPSHandler) Summarize(ctx context.Context, q url.Values, track []byte) (*placenames.TrackSummary, error) {
+	gs, err := h.summarizer(q)
+	if err != nil {
+		return nil, err
+	}
+	stopsIndex, err := h.stopsIndex(ctx, q.Get("stops"))
+	if err != nil {
+		return nil, err
+	}
+	return gs.SummarizeTrackContext(ctx, bytes.NewReader(track), stopsIndex)
+}
+
+// stopsIndex returns the named refreshment stops, or nil if name is empty.
+func (h *RWGPSHandler) stopsIndex(ctx context.Context, name string) (*rtreego.Rtree, error) {
+	if name == "" {
+		return nil, nil
+	}
+	return h.stops.GetContext(ctx, name)
+}
+
+// summaryKey identifies the parameters that affect a route summary.
+func summaryKey(q url.Values) string {
+	k := make(url.Values)
+	for _, name := range []string{"stops", "sr", "sdd", "dd", "md", "ms"} {
+		if v := q.Get(name); v != "" {
+			k.Set(name, v)
+		}
+	}
+	return k.Encode()
+}
+
+// target is the route to summarize: a RideWithGPS route or trip, or a route id from
+// another source.
+type target struct {
+	ref    Ref
+	source sources.RouteSource
+	id     string
+}
+
+func (t target) String() string {
+	if t.source != nil {
+		return t.source.Name() + "/" + t.id
+	}
+	return t.ref.String()
+}
+
+// parseTarget works out the route to summarize. The source parameter selects a source other
+// than RideWithGPS, with the route given by id or url. Without it, the route is given by
+// routeId, tripId or url, and a url that does not belong to RideWithGPS is looked up in the
+// other sources.
+func (h *RWGPSHandler) parseTarget(q url.Values) (target, error) {
+	name := q.Get("source")
+	if name == "" || name == h.client.Name() {
+		ref, err := parseRef(q)
+		if errors.Is(err, ErrInvalidRef) && name == "" && h.sources != nil {
+			// The url may belong to another source
+			src, id, err := h.sources.ForURL(q.Get("url"))
+			if err != nil {
+				return target{}, err
+			}
+			return target{source: src, id: id}, nil
+		}
+		return target{ref: ref}, err
+	}
+	if h.sources == nil {
+		return target{}, fmt.Errorf("%w: %s", sources.ErrUnknownSource, name)
+	}
+	src, err := h.sources.Get(name)
+	if err != nil {
+		return target{}, err
+	}
+	id := q.Get("id")
+	if rawURL := q.Get("url"); rawURL != "" {
+		var ok bool
+		if id, ok = src.ParseURL(rawURL); !ok {
+			return target{}, fmt.Errorf("not a %s route: %s", name, rawURL)
+		}
+	}
+	if id == "" {
+		return target{}, fmt.Errorf("id or url is required for source %s", name)
+	}
+	return target{source: src, id: id}, nil
+}
+
+// parseRef returns the route or trip identified by exactly one of the routeId, tripId or url
+// parameters.
+func parseRef(q url.Values) (Ref, error) {
+	var refs []Ref
+	for _, kind := range []struct {
+		param string
+		ref   func(int) Ref
+	}{{"routeId", RouteRef}, {"tripId", TripRef}} {
+		raw := q.Get(kind.param)
+		if raw == "" {
+			continue
+		}
+		id, err := strconv.Atoi(raw)
+		if err != nil || id <= 0 {
+			return Ref{}, fmt.Errorf("Invalid %s: %s", kind.param, raw)
+		}
+		refs = append(refs, kind.ref(id))
+	}
+	if raw := q.Get("url"); raw != "" {
+		ref, err := ParseRef(raw)
+		if err != nil {
+			return Ref{}, err
+		}
+		refs = append(refs, ref)
+	}
+	switch len(refs) {
+	case 0:
+		return Ref{}, errors.New("one of routeId, tripId or url is required")
+	case 1:
+		return refs[0], nil
+	default:
+		return Ref{}, errors.New("only one of routeId, tripId or url may be given")
 	}
-	w.Header().Add("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(result)
 }
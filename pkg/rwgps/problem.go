@@ -0,0 +1,97 @@
+package rwgps
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/ray1729/gpx-utils/pkg/cafes"
+	"github.com/ray1729/gpx-utils/pkg/placenames"
+	"github.com/ray1729/gpx-utils/pkg/sources"
+)
+
+// Problem is an RFC 7807 problem details response.
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// writeProblem writes a problem details response with the given status and detail.
+func writeProblem(w http.ResponseWriter, status int, detail string) {
+	body, err := json.Marshal(Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	})
+	if err != nil {
+		http.Error(w, detail, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// writeError writes a problem details response for err, with a status reflecting its cause.
+func writeError(w http.ResponseWriter, err error) {
+	status, detail := ErrorResponse(err)
+	if status == 0 {
+		// The client has gone away, so there is nobody to report to.
+		return
+	}
+	writeProblem(w, status, detail)
+}
+
+// ErrorResponse returns the HTTP status reflecting the cause of err, and a description of it
+// that is safe to show to the client. The status is 0 if the request was cancelled.
+func ErrorResponse(err error) (int, string) {
+	status := errorStatus(err)
+	switch status {
+	case http.StatusInternalServerError:
+		return status, "internal error"
+	case http.StatusGatewayTimeout:
+		return status, "timed out"
+	default:
+		return status, err.Error()
+	}
+}
+
+// errorStatus returns the HTTP status for err, or 0 if the request was cancelled.
+func errorStatus(err error) int {
+	var notFound *ErrNotFound
+	var notPublic *ErrNotPublic
+	switch {
+	case errors.Is(err, context.Canceled):
+		return 0
+	case errors.Is(err, context.DeadlineExceeded), isTimeout(err):
+		return http.StatusGatewayTimeout
+	case errors.As(err, &notFound), errors.Is(err, sources.ErrNotFound):
+		return http.StatusNotFound
+	case errors.As(err, &notPublic), errors.Is(err, sources.ErrNotAuthorized):
+		return http.StatusForbidden
+	case errors.Is(err, cafes.ErrInvalidStops), errors.Is(err, placenames.ErrInvalidOption), errors.Is(err, ErrInvalidRef), errors.Is(err, ErrInvalidRequest),
+		errors.Is(err, sources.ErrUnknownSource), errors.Is(err, sources.ErrUnknownURL), errors.Is(err, sources.ErrInvalidID):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrTrackTooLarge), errors.Is(err, sources.ErrTooLarge), errors.Is(err, placenames.ErrTooManyPoints):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, placenames.ErrInvalidGPX),
+		errors.Is(err, placenames.ErrEmptyTrack),
+		errors.Is(err, placenames.ErrOutOfCoverage):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrUpstream), errors.Is(err, cafes.ErrUpstream), errors.Is(err, sources.ErrUpstream):
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
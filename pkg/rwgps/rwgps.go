@@ -1,9 +1,18 @@
 package rwgps
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type ErrNotFound struct {
@@ -22,25 +31,360 @@ func (e *ErrNotPublic) Error() string {
 	return fmt.Sprintf("RideWithGPS track %d is not public", e.RouteId)
 }
 
+var (
+	ErrTrackTooLarge = errors.New("track too large")
+	ErrUpstream      = errors.New("error fetching from RideWithGPS")
+)
+
+// UpstreamError reports a failed request to RideWithGPS. It matches ErrUpstream, and unwraps
+// to the underlying error.
+type UpstreamError struct {
+	URL        string
+	StatusCode int // 0 if no response was received
+	Err        error
+}
+
+// redactURL returns u with the privacy code, if any, replaced, so that it can be logged and
+// returned in errors.
+func redactURL(u *url.URL) string {
+	q := u.Query()
+	if q.Get("privacy_code") == "" {
+		return u.String()
+	}
+	q.Set("privacy_code", "REDACTED")
+	r := *u
+	r.RawQuery = q.Encode()
+	return r.String()
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("error fetching %s: %v", e.URL, e.Err)
+}
+
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+func (e *UpstreamError) Is(target error) bool {
+	return target == ErrUpstream
+}
+
+// DefaultBaseURL is the RideWithGPS site used when a Client has no BaseURL.
+const DefaultBaseURL = "https://ridewithgps.com"
+
+// Client fetches routes and trips from RideWithGPS. Without credentials only public routes
+// can be fetched; with an API key and the auth token of a user, it can also fetch the
+// private routes of that user and of clubs they belong to.
+type Client struct {
+	HTTPClient *http.Client
+	// BaseURL overrides DefaultBaseURL, for example to test against a fake server.
+	BaseURL   string
+	APIKey    string
+	AuthToken string
+	// MaxSize is the maximum size (in bytes) of a track, or 0 for no limit.
+	MaxSize int64
+}
+
+var DefaultClient = &Client{
+	HTTPClient: &http.Client{Timeout: 30 * time.Second},
+	MaxSize:    10 << 20,
+}
+
+// NewClientFromEnv returns a client configured from the environment variables RWGPS_BASE_URL,
+// RWGPS_API_KEY and RWGPS_AUTH_TOKEN, with the timeout and size limit of DefaultClient.
+func NewClientFromEnv() *Client {
+	return &Client{
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+		BaseURL:    os.Getenv("RWGPS_BASE_URL"),
+		APIKey:     os.Getenv("RWGPS_API_KEY"),
+		AuthToken:  os.Getenv("RWGPS_AUTH_TOKEN"),
+		MaxSize:    DefaultClient.MaxSize,
+	}
+}
+
+// FetchTrack fetches a route in GPX format using the DefaultClient.
 func FetchTrack(routeId int) ([]byte, error) {
-	url := fmt.Sprintf("https://ridewithgps.com/routes/%d.gpx?sub_format=track", routeId)
-	resp, err := http.Get(url)
+	return DefaultClient.FetchTrack(context.Background(), routeId)
+}
+
+// FetchTrackContext is like FetchTrack, but the request is cancelled when ctx is done.
+func FetchTrackContext(ctx context.Context, routeId int) ([]byte, error) {
+	return DefaultClient.FetchTrack(ctx, routeId)
+}
+
+// Track is a route in GPX format, with the validators needed to revalidate a cached copy.
+type Track struct {
+	Data         []byte
+	ETag         string
+	LastModified string
+	Fetched      time.Time
+}
+
+// FetchTrack fetches a route in GPX format. It returns ErrTrackTooLarge if the track
+// exceeds c.MaxSize.
+func (c *Client) FetchTrack(ctx context.Context, routeId int) ([]byte, error) {
+	return c.FetchRef(ctx, RouteRef(routeId))
+}
+
+// FetchRef fetches a route or trip in GPX format. Trips include the time of each point.
+func (c *Client) FetchRef(ctx context.Context, ref Ref) ([]byte, error) {
+	t, _, err := c.RevalidateTrack(ctx, ref, nil)
+	if err != nil {
+		return nil, err
+	}
+	return t.Data, nil
+}
+
+// Name identifies RideWithGPS as a route source.
+func (c *Client) Name() string {
+	return "rwgps"
+}
+
+// ParseURL returns the ID of the route or trip at a RideWithGPS URL, as returned by
+// Ref.Path, e.g. "routes/123".
+func (c *Client) ParseURL(rawURL string) (string, bool) {
+	ref, err := ParseRef(rawURL)
+	if err != nil {
+		return "", false
+	}
+	return ref.Path(), true
+}
+
+// FetchGPX fetches a route or trip given an ID returned by ParseURL, or a route ID.
+func (c *Client) FetchGPX(ctx context.Context, id string) ([]byte, error) {
+	if routeId, err := strconv.Atoi(id); err == nil {
+		return c.FetchRef(ctx, RouteRef(routeId))
+	}
+	ref, err := ParseRef("ridewithgps.com/" + id)
 	if err != nil {
-		return nil, fmt.Errorf("error getting %s: %v", url, err)
+		return nil, err
+	}
+	return c.FetchRef(ctx, ref)
+}
+
+// RevalidateTrack fetches a route or trip unless it is unchanged since prev was fetched, in
+// which case it returns prev with an updated fetch time and false. prev may be nil.
+func (c *Client) RevalidateTrack(ctx context.Context, ref Ref, prev *Track) (*Track, bool, error) {
+	req, err := c.newRequest(ctx, ref.gpxPath())
+	if err != nil {
+		return nil, false, err
+	}
+	if prev != nil {
+		if prev.ETag != "" {
+			req.Header.Set("If-None-Match", prev.ETag)
+		}
+		if prev.LastModified != "" {
+			req.Header.Set("If-Modified-Since", prev.LastModified)
+		}
+	}
+	resp, err := c.do(req, ref.ID)
+	if err != nil {
+		return nil, false, err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		if resp.StatusCode == http.StatusNotFound {
-			return nil, &ErrNotFound{routeId}
+	if resp.StatusCode == http.StatusNotModified {
+		if prev == nil {
+			return nil, false, &UpstreamError{URL: redactURL(req.URL), StatusCode: resp.StatusCode, Err: errors.New("unexpected Not Modified response")}
+		}
+		t := *prev
+		t.Fetched = time.Now()
+		return &t, false, nil
+	}
+	data, err := readAtMost(resp.Body, c.MaxSize)
+	if err != nil {
+		if errors.Is(err, ErrTrackTooLarge) {
+			return nil, false, fmt.Errorf("error reading %s: %w", ref, err)
 		}
-		if resp.StatusCode == http.StatusForbidden {
-			return nil, &ErrNotPublic{routeId}
+		return nil, false, &UpstreamError{URL: redactURL(req.URL), StatusCode: resp.StatusCode, Err: err}
+	}
+	t := &Track{
+		Data:         data,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Fetched:      time.Now(),
+	}
+	return t, true, nil
+}
+
+// TrackPoint is a point of a route or trip returned by the RideWithGPS API.
+type TrackPoint struct {
+	Lon      float64 `json:"x"`
+	Lat      float64 `json:"y"`
+	Ele      float64 `json:"e"`
+	Distance float64 `json:"d"`           // metres from the start
+	Time     int64   `json:"t,omitempty"` // Unix time, trips only
+}
+
+// Route is a planned route returned by the RideWithGPS API. Distances are in metres.
+type Route struct {
+	ID            int          `json:"id"`
+	Name          string       `json:"name"`
+	Description   string       `json:"description"`
+	Distance      float64      `json:"distance"`
+	ElevationGain float64      `json:"elevation_gain"`
+	ElevationLoss float64      `json:"elevation_loss"`
+	UserID        int          `json:"user_id"`
+	CreatedAt     time.Time    `json:"created_at"`
+	UpdatedAt     time.Time    `json:"updated_at"`
+	TrackPoints   []TrackPoint `json:"track_points"`
+}
+
+// Trip is a recorded ride returned by the RideWithGPS API. Distances are in metres and times
+// in seconds.
+type Trip struct {
+	ID            int          `json:"id"`
+	Name          string       `json:"name"`
+	Description   string       `json:"description"`
+	Distance      float64      `json:"distance"`
+	ElevationGain float64      `json:"elevation_gain"`
+	ElevationLoss float64      `json:"elevation_loss"`
+	Duration      float64      `json:"duration"`
+	MovingTime    float64      `json:"moving_time"`
+	DepartedAt    time.Time    `json:"departed_at"`
+	UserID        int          `json:"user_id"`
+	CreatedAt     time.Time    `json:"created_at"`
+	UpdatedAt     time.Time    `json:"updated_at"`
+	TrackPoints   []TrackPoint `json:"track_points"`
+}
+
+// FetchRoute fetches a route, including its track points, from the RideWithGPS API.
+func (c *Client) FetchRoute(ctx context.Context, routeId int) (*Route, error) {
+	var body struct {
+		Route *Route `json:"route"`
+	}
+	if err := c.getJSON(ctx, fmt.Sprintf("/api/v1/routes/%d.json", routeId), routeId, &body); err != nil {
+		return nil, err
+	}
+	if body.Route == nil {
+		return nil, &ErrNotFound{routeId}
+	}
+	return body.Route, nil
+}
+
+// FetchTrip fetches a trip, including its track points, from the RideWithGPS API.
+func (c *Client) FetchTrip(ctx context.Context, tripId int) (*Trip, error) {
+	var body struct {
+		Trip *Trip `json:"trip"`
+	}
+	if err := c.getJSON(ctx, fmt.Sprintf("/api/v1/trips/%d.json", tripId), tripId, &body); err != nil {
+		return nil, err
+	}
+	if body.Trip == nil {
+		return nil, &ErrNotFound{tripId}
+	}
+	return body.Trip, nil
+}
+
+// Owner identifies a RideWithGPS user or club whose routes are listed.
+type Owner struct {
+	Kind string // "users" or "clubs"
+	ID   int
+}
+
+func (o Owner) String() string {
+	return fmt.Sprintf("%s/%d", o.Kind, o.ID)
+}
+
+// ListRoutes returns up to limit routes of a user or club starting at offset, without their
+// track points, and the total number of routes.
+func (c *Client) ListRoutes(ctx context.Context, owner Owner, offset, limit int) ([]Route, int, error) {
+	var body struct {
+		Results      []Route `json:"results"`
+		ResultsCount int     `json:"results_count"`
+	}
+	path := fmt.Sprintf("/%s/%d/routes.json?offset=%d&limit=%d", owner.Kind, owner.ID, offset, limit)
+	if err := c.getJSON(ctx, path, owner.ID, &body); err != nil {
+		return nil, 0, err
+	}
+	return body.Results, body.ResultsCount, nil
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, id int, v interface{}) error {
+	req, err := c.newRequest(ctx, path)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.do(req, id)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := readAtMost(resp.Body, c.MaxSize)
+	if err != nil {
+		if errors.Is(err, ErrTrackTooLarge) {
+			return fmt.Errorf("error reading %s: %w", path, err)
 		}
-		return nil, fmt.Errorf("error retrieving route %d: %s", routeId, resp.Status)
+		return &UpstreamError{URL: redactURL(req.URL), StatusCode: resp.StatusCode, Err: err}
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return &UpstreamError{URL: redactURL(req.URL), StatusCode: resp.StatusCode, Err: fmt.Errorf("error decoding JSON: %v", err)}
+	}
+	return nil
+}
+
+// newRequest constructs a GET request for path on the RideWithGPS site, with credentials
+// if the client has them.
+func (c *Client) newRequest(ctx context.Context, path string) (*http.Request, error) {
+	baseURL := c.BaseURL
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	url := strings.TrimRight(baseURL, "/") + path
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error constructing request for %s: %v", url, err)
+	}
+	req.Header.Set("User-Agent", "gpx-utils")
+	if c.APIKey != "" {
+		req.Header.Set("x-rwgps-api-key", c.APIKey)
 	}
-	data, err := ioutil.ReadAll(resp.Body)
+	if c.AuthToken != "" {
+		req.Header.Set("x-rwgps-auth-token", c.AuthToken)
+	}
+	return req, nil
+}
+
+// do sends req, returning an error unless the response status is OK or Not Modified. id is
+// the route or trip requested, for error reporting.
+func (c *Client) do(req *http.Request, id int) (*http.Response, error) {
+	resp, err := c.httpClient().Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("error reading response from %s: %v", url, err)
+		return nil, &UpstreamError{URL: redactURL(req.URL), Err: err}
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNotModified:
+		return resp, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, &ErrNotFound{id}
+	case http.StatusForbidden:
+		resp.Body.Close()
+		return nil, &ErrNotPublic{id}
+	default:
+		resp.Body.Close()
+		return nil, &UpstreamError{URL: redactURL(req.URL), StatusCode: resp.StatusCode, Err: fmt.Errorf("unexpected status %s", resp.Status)}
+	}
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// readAtMost reads r to EOF, returning ErrTrackTooLarge if it holds more than max bytes.
+func readAtMost(r io.Reader, max int64) ([]byte, error) {
+	if max <= 0 {
+		return ioutil.ReadAll(r)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > max {
+		return nil, fmt.Errorf("%w: more than %d bytes", ErrTrackTooLarge, max)
 	}
 	return data, nil
 }
@@ -0,0 +1,274 @@
+package rwgps
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testGPX = `<?xml version="1.0" encoding="UTF-8"?>
+<gpx version="1.1" creator="http://ridewithgps.com/" xmlns="http://www.topografix.com/GPX/1/1">
+<metadata><name>Test route</name></metadata>
+<trk><name>Test route</name><trkseg>
+<trkpt lat="52.2053" lon="0.1218"><ele>14.2</ele></trkpt>
+<trkpt lat="52.2101" lon="0.1180"><ele>13.8</ele></trkpt>
+</trkseg></trk>
+</gpx>
+`
+
+// fakeRWGPS is a RideWithGPS site serving one version of each route, which supports
+// conditional requests.
+type fakeRWGPS struct {
+	*httptest.Server
+	mu       sync.Mutex
+	routes   map[string]string // path to GPX
+	etag     string
+	modified string
+	requests []*http.Request
+}
+
+func newFakeRWGPS(t *testing.T) *fakeRWGPS {
+	t.Helper()
+	f := &fakeRWGPS{
+		routes:   map[string]string{"/routes/1.gpx": testGPX, "/trips/2.gpx": testGPX},
+		etag:     `"v1"`,
+		modified: "Sun, 01 Jun 2025 10:00:00 GMT",
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeRWGPS) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r)
+	switch r.URL.Path {
+	case "/routes/403.gpx":
+		w.WriteHeader(http.StatusForbidden)
+		return
+	case "/routes/500.gpx":
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	case "/api/v1/routes/1.json":
+		w.Write([]byte(`{"route":{"id":1,"name":"Test route","distance":1234.5,"updated_at":"2025-06-01T10:00:00Z","track_points":[{"x":0.1218,"y":52.2053,"e":14.2,"d":0}]}}`))
+		return
+	case "/api/v1/routes/2.json":
+		w.Write([]byte(`<html>Service unavailable</html>`))
+		return
+	}
+	data, ok := f.routes[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Header.Get("If-None-Match") == f.etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", f.etag)
+	w.Header().Set("Last-Modified", f.modified)
+	w.Write([]byte(data))
+}
+
+func (f *fakeRWGPS) lastRequest() *http.Request {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[len(f.requests)-1]
+}
+
+// update changes a route, as if its owner had edited it.
+func (f *fakeRWGPS) update(path, data, etag string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.routes[path] = data
+	f.etag = etag
+}
+
+func TestFetchRefHeaders(t *testing.T) {
+	f := newFakeRWGPS(t)
+	ctx := context.Background()
+
+	c := &Client{BaseURL: f.URL}
+	if _, err := c.FetchRef(ctx, RouteRef(1)); err != nil {
+		t.Fatalf("FetchRef: %v", err)
+	}
+	r := f.lastRequest()
+	if r.URL.RequestURI() != "/routes/1.gpx?sub_format=track" {
+		t.Errorf("got request for %s", r.URL.RequestURI())
+	}
+	if r.Header.Get("User-Agent") != "gpx-utils" {
+		t.Errorf("got User-Agent %q", r.Header.Get("User-Agent"))
+	}
+	for _, h := range []string{"x-rwgps-api-key", "x-rwgps-auth-token"} {
+		if v := r.Header.Get(h); v != "" {
+			t.Errorf("client without credentials sent %s: %q", h, v)
+		}
+	}
+
+	c = &Client{BaseURL: f.URL + "/", APIKey: "key", AuthToken: "token"}
+	if _, err := c.FetchRef(ctx, Ref{Kind: KindTrip, ID: 2, PrivacyCode: "a b"}); err != nil {
+		t.Fatalf("FetchRef: %v", err)
+	}
+	r = f.lastRequest()
+	if r.URL.Path != "/trips/2.gpx" || r.URL.Query().Get("privacy_code") != "a b" {
+		t.Errorf("got request for %s", r.URL.RequestURI())
+	}
+	if r.Header.Get("x-rwgps-api-key") != "key" || r.Header.Get("x-rwgps-auth-token") != "token" {
+		t.Errorf("got credentials %q %q", r.Header.Get("x-rwgps-api-key"), r.Header.Get("x-rwgps-auth-token"))
+	}
+}
+
+func TestRevalidateTrack(t *testing.T) {
+	f := newFakeRWGPS(t)
+	c := &Client{BaseURL: f.URL}
+	ctx := context.Background()
+
+	first, modified, err := c.RevalidateTrack(ctx, RouteRef(1), nil)
+	if err != nil {
+		t.Fatalf("RevalidateTrack: %v", err)
+	}
+	if !modified || string(first.Data) != testGPX || first.ETag != `"v1"` || first.LastModified == "" {
+		t.Fatalf("got modified %v, track %+v", modified, first)
+	}
+
+	first.Fetched = time.Now().Add(-time.Hour)
+	second, modified, err := c.RevalidateTrack(ctx, RouteRef(1), first)
+	if err != nil {
+		t.Fatalf("RevalidateTrack: %v", err)
+	}
+	r := f.lastRequest()
+	if r.Header.Get("If-None-Match") != `"v1"` || r.Header.Get("If-Modified-Since") != first.LastModified {
+		t.Errorf("got validators %q %q", r.Header.Get("If-None-Match"), r.Header.Get("If-Modified-Since"))
+	}
+	if modified {
+		t.Error("unchanged route reported modified")
+	}
+	if !bytes.Equal(second.Data, first.Data) || !second.Fetched.After(first.Fetched) {
+		t.Errorf("revalidated track has %d bytes fetched at %s", len(second.Data), second.Fetched)
+	}
+
+	changed := strings.Replace(testGPX, "Test route", "Revised route", -1)
+	f.update("/routes/1.gpx", changed, `"v2"`)
+	third, modified, err := c.RevalidateTrack(ctx, RouteRef(1), second)
+	if err != nil {
+		t.Fatalf("RevalidateTrack: %v", err)
+	}
+	if !modified || string(third.Data) != changed || third.ETag != `"v2"` {
+		t.Errorf("got modified %v, ETag %s for a changed route", modified, third.ETag)
+	}
+}
+
+func TestFetchRefErrors(t *testing.T) {
+	f := newFakeRWGPS(t)
+	ctx := context.Background()
+	c := &Client{BaseURL: f.URL}
+
+	var notPublic *ErrNotPublic
+	if _, err := c.FetchRef(ctx, RouteRef(403)); !errors.As(err, &notPublic) || notPublic.RouteId != 403 {
+		t.Errorf("private route: got error %v", err)
+	}
+	var notFound *ErrNotFound
+	if _, err := c.FetchRef(ctx, RouteRef(404)); !errors.As(err, &notFound) || notFound.RouteId != 404 {
+		t.Errorf("missing route: got error %v", err)
+	}
+	var upstream *UpstreamError
+	if _, err := c.FetchRef(ctx, RouteRef(500)); !errors.As(err, &upstream) || upstream.StatusCode != 500 || !errors.Is(err, ErrUpstream) {
+		t.Errorf("server error: got error %v", err)
+	}
+
+	c.MaxSize = int64(len(testGPX))
+	if _, err := c.FetchRef(ctx, RouteRef(1)); err != nil {
+		t.Errorf("track of exactly MaxSize: got error %v", err)
+	}
+	c.MaxSize--
+	if _, err := c.FetchRef(ctx, RouteRef(1)); !errors.Is(err, ErrTrackTooLarge) {
+		t.Errorf("track over MaxSize: got error %v, want %v", err, ErrTrackTooLarge)
+	}
+
+	down := &Client{BaseURL: "http://127.0.0.1:1"}
+	if _, err := down.FetchRef(ctx, RouteRef(1)); !errors.As(err, &upstream) || upstream.StatusCode != 0 {
+		t.Errorf("unreachable site: got error %v", err)
+	}
+}
+
+func TestFetchRoute(t *testing.T) {
+	f := newFakeRWGPS(t)
+	c := &Client{BaseURL: f.URL}
+	ctx := context.Background()
+
+	route, err := c.FetchRoute(ctx, 1)
+	if err != nil {
+		t.Fatalf("FetchRoute: %v", err)
+	}
+	if route.ID != 1 || route.Name != "Test route" || len(route.TrackPoints) != 1 || !route.UpdatedAt.Equal(time.Date(2025, 6, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("got route %+v", route)
+	}
+	if accept := f.lastRequest().Header.Get("Accept"); accept != "application/json" {
+		t.Errorf("got Accept %q", accept)
+	}
+	if _, err := c.FetchRoute(ctx, 2); !errors.Is(err, ErrUpstream) {
+		t.Errorf("malformed response: got error %v, want %v", err, ErrUpstream)
+	}
+}
+
+func TestRefPrivacyCode(t *testing.T) {
+	ref := Ref{Kind: KindTrip, ID: 5, PrivacyCode: "s3cret"}
+	if s := ref.String(); s != "trips/5" {
+		t.Errorf("String() = %q, want trips/5", s)
+	}
+	if p := ref.Path(); p != "trips/5?privacy_code=s3cret" {
+		t.Errorf("Path() = %q", p)
+	}
+	if p := ref.gpxPath(); p != "/trips/5.gpx?sub_format=track&privacy_code=s3cret" {
+		t.Errorf("gpxPath() = %q", p)
+	}
+	key := refKey(ref)
+	if strings.Contains(key, "s3cret") || key == refKey(TripRef(5)) {
+		t.Errorf("refKey() = %q, want a key apart from the public trip without the code", key)
+	}
+	cache := &RouteCache{dir: "cache"}
+	if name := cache.trackPath(ref, "gpx"); strings.Contains(name, "s3cret") {
+		t.Errorf("cache file %s contains the privacy code", name)
+	}
+}
+
+func TestUpstreamErrorRedacted(t *testing.T) {
+	f := newFakeRWGPS(t)
+	c := &Client{BaseURL: f.URL}
+	_, err := c.FetchRef(context.Background(), Ref{Kind: KindRoute, ID: 500, PrivacyCode: "s3cret"})
+	if err == nil || strings.Contains(err.Error(), "s3cret") || !strings.Contains(err.Error(), "privacy_code=REDACTED") {
+		t.Errorf("got error %v, want the privacy code redacted", err)
+	}
+	if got := f.lastRequest().URL.Query().Get("privacy_code"); got != "s3cret" {
+		t.Errorf("request sent privacy code %q", got)
+	}
+}
+
+func TestHandlerPrivate(t *testing.T) {
+	h := &RWGPSHandler{client: &Client{}}
+	for _, tc := range []struct {
+		query string
+		want  bool
+	}{
+		{"routeId=1", false},
+		{"url=https://ridewithgps.com/trips/5", false},
+		{"url=" + url.QueryEscape("https://ridewithgps.com/trips/5?privacy_code=s3cret"), true},
+		{"url=not-a-route", false},
+	} {
+		q, err := url.ParseQuery(tc.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := h.Private(q); got != tc.want {
+			t.Errorf("Private(%s) = %v, want %v", tc.query, got, tc.want)
+		}
+	}
+}
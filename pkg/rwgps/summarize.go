@@ -0,0 +1,135 @@
+package rwgps
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/ray1729/gpx-utils/pkg/placenames"
+	"github.com/ray1729/gpx-utils/pkg/requestid"
+)
+
+// ServeSummarize summarizes a GPX track POSTed as the request body, or as the first file in
+// a multipart/form-data upload. It accepts the stops parameter and the summarizer tuning
+// parameters of analyze-gpx (sr, sdd, dd, md and ms) in the query string.
+func (h *RWGPSHandler) ServeSummarize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeProblem(w, http.StatusMethodNotAllowed, "use POST to upload a GPX track")
+		return
+	}
+	ctx := r.Context()
+	q := r.URL.Query()
+	stopsName := q.Get("stops")
+	requestid.Printf(ctx, "Handling summarize request stops=%s", stopsName)
+	gs, err := h.summarizer(q)
+	if err != nil {
+		requestid.Println(ctx, err)
+		writeProblem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if h.conf.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.conf.Timeout)
+		defer cancel()
+	}
+	track, err := readUpload(r, h.conf.MaxSize)
+	if err != nil {
+		requestid.Printf(ctx, "Error reading upload: %v", err)
+		if errors.Is(err, ErrTrackTooLarge) {
+			writeError(w, err)
+		} else {
+			writeProblem(w, http.StatusBadRequest, err.Error())
+		}
+		return
+	}
+	stopsIndex, err := h.stopsIndex(ctx, stopsName)
+	if err != nil {
+		requestid.Println(ctx, err)
+		writeError(w, err)
+		return
+	}
+	summary, err := gs.SummarizeTrackContext(ctx, bytes.NewReader(track), stopsIndex)
+	if err != nil {
+		requestid.Printf(ctx, "Error analyzing upload: %v", err)
+		writeError(w, err)
+		return
+	}
+	result, err := json.Marshal(summary)
+	if err != nil {
+		requestid.Printf(ctx, "Error marshalling JSON for upload: %v", err)
+		writeError(w, err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(result)
+}
+
+// readUpload returns the GPX document in the body of r, reading at most maxSize bytes.
+func readUpload(r *http.Request, maxSize int64) ([]byte, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		return readAtMost(r.Body, maxSize)
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, fmt.Errorf("error reading multipart body: %v", err)
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, errors.New("no file in multipart upload")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading multipart body: %v", err)
+		}
+		if part.FileName() != "" {
+			defer part.Close()
+			return readAtMost(part, maxSize)
+		}
+		part.Close()
+	}
+}
+
+// summarizer returns the server-wide summarizer with the tuning parameters in q applied:
+//
+//	sr   CoffeeStopSearchRectangleSize (m)
+//	sdd  CoffeeStopDuplicateDistance (km)
+//	dd   PointOfInterestDuplicateDistance (km)
+//	md   PointOfInterestMinimumDistance (km)
+//	ms   minimum settlement type (City, Town, Village, Hamlet or Other Settlement)
+func (h *RWGPSHandler) summarizer(q url.Values) (*placenames.GPXSummarizer, error) {
+	var opts []placenames.Option
+	distances := []struct {
+		name   string
+		option func(float64) placenames.Option
+	}{
+		{"sr", placenames.WithCoffeeStopSearchRectangleSize},
+		{"sdd", placenames.WithCoffeeStopDuplicateDistance},
+		{"dd", placenames.WithPointOfInterestDuplicateDistance},
+		{"md", placenames.WithPointOfInterestMinimumDistance},
+	}
+	for _, d := range distances {
+		raw := q.Get(d.name)
+		if raw == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s %s (expected a number)", placenames.ErrInvalidOption, d.name, raw)
+		}
+		opts = append(opts, d.option(v))
+	}
+	if ms := q.Get("ms"); ms != "" {
+		opts = append(opts, placenames.WithMinimumSettlement(ms))
+	}
+	return h.gs.WithOptions(opts...)
+}
@@ -0,0 +1,433 @@
+package rwgps
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ray1729/gpx-utils/pkg/placenames"
+	"github.com/ray1729/gpx-utils/pkg/requestid"
+)
+
+// ErrNotWatched is returned by Notify for a route that is not watched.
+var ErrNotWatched = errors.New("route is not watched")
+
+// Watcher keeps the summaries of RideWithGPS routes up to date. Each watched route is checked
+// when a webhook reports a change to it and, optionally, at regular intervals, with a
+// conditional request for its GPX, which needs no API credentials. When the route has changed,
+// it is summarized again and, if the summary has changed, the new summary is posted to the
+// callback URL.
+type Watcher struct {
+	h        *RWGPSHandler
+	callback string
+	conf     WatchConfig
+	routes   []*watchedRoute
+	client   *http.Client
+	queue    chan int // route IDs to check
+	mu       sync.Mutex
+	pending  map[int]bool
+	state    map[string]*watchState
+}
+
+// WatchConfig holds the settings of a Watcher.
+type WatchConfig struct {
+	Interval  time.Duration // time between checks of every route, 0 to rely on webhooks
+	Secret    string        // authenticates webhooks and signs callbacks, empty for neither
+	StateFile string        // file recording the summaries posted, empty to keep them in memory
+	Retries   int           // times a failed callback is retried
+}
+
+var DefaultWatchConfig = WatchConfig{
+	Interval: 15 * time.Minute,
+	Retries:  3,
+}
+
+type WatchOption func(*WatchConfig)
+
+// WithWatchInterval overrides the time between checks of every route. Default 15m.
+func WithWatchInterval(d time.Duration) WatchOption {
+	return func(c *WatchConfig) {
+		c.Interval = d
+	}
+}
+
+// WithWatchSecret sets the secret that webhooks must present, and with which callbacks are
+// signed.
+func WithWatchSecret(secret string) WatchOption {
+	return func(c *WatchConfig) {
+		c.Secret = secret
+	}
+}
+
+// WithWatchStateFile sets the file recording the summaries posted, so that they are not
+// posted again when the server restarts.
+func WithWatchStateFile(filename string) WatchOption {
+	return func(c *WatchConfig) {
+		c.StateFile = filename
+	}
+}
+
+// watchedRoute is a route and the parameters it is summarized with.
+type watchedRoute struct {
+	ref    Ref
+	params url.Values
+	key    string
+}
+
+// watchState records the last version of a route whose summary was posted, and the
+// validators used to check whether it has changed.
+type watchState struct {
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	Track        string    `json:"track"`   // hash of the GPX
+	Summary      string    `json:"summary"` // hash of the summary
+	UpdatedAt    time.Time `json:"updatedAt"`
+}
+
+// Callback is the body posted to the callback URL when a route's summary changes.
+type Callback struct {
+	RouteID   int                      `json:"routeId"`
+	Params    string                   `json:"params"` // the parameters the route is watched with
+	Link      string                   `json:"link"`
+	UpdatedAt time.Time                `json:"updatedAt"` // the route's Last-Modified time, or when the change was seen
+	Summary   *placenames.TrackSummary `json:"summary"`
+}
+
+// NewWatcher returns a watcher of routes, which posts their summaries to callback. Each route
+// is a route ID, the URL of a route, or the query parameters of a /rwgps request for a route,
+// such as "routeId=123&stops=ctccambridge".
+func NewWatcher(h *RWGPSHandler, callback string, routes []string, opts ...WatchOption) (*Watcher, error) {
+	conf := DefaultWatchConfig
+	for _, f := range opts {
+		f(&conf)
+	}
+	if len(routes) == 0 {
+		return nil, errors.New("no routes to watch")
+	}
+	if u, err := url.Parse(callback); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid callback URL: %s", callback)
+	}
+	w := &Watcher{
+		h:        h,
+		callback: callback,
+		conf:     conf,
+		client:   &http.Client{Timeout: 30 * time.Second, Transport: h.conf.Transport},
+		queue:    make(chan int, len(routes)),
+		pending:  make(map[int]bool),
+		state:    make(map[string]*watchState),
+	}
+	for _, s := range routes {
+		r, err := parseWatched(s)
+		if err != nil {
+			return nil, err
+		}
+		w.routes = append(w.routes, r)
+	}
+	if err := w.load(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// parseWatched parses a route given to NewWatcher.
+func parseWatched(s string) (*watchedRoute, error) {
+	params := make(url.Values)
+	switch {
+	case strings.Contains(s, "="):
+		var err error
+		if params, err = url.ParseQuery(s); err != nil {
+			return nil, fmt.Errorf("invalid watched route %s: %v", s, err)
+		}
+	case strings.Trim(s, "0123456789") == "":
+		params.Set("routeId", s)
+	default:
+		params.Set("url", s)
+	}
+	ref, err := parseRef(params)
+	if err != nil {
+		return nil, fmt.Errorf("invalid watched route %s: %v", s, err)
+	}
+	if ref.Kind != KindRoute {
+		return nil, fmt.Errorf("invalid watched route %s: only routes can be watched", s)
+	}
+	return &watchedRoute{ref: ref, params: params, key: params.Encode()}, nil
+}
+
+// Notify queues a check of the route with the given ID.
+func (w *Watcher) Notify(routeID int) error {
+	for _, r := range w.routes {
+		if r.ref.ID == routeID {
+			w.enqueue(routeID)
+			return nil
+		}
+	}
+	return ErrNotWatched
+}
+
+// enqueue queues a check of a route, unless one is already queued.
+func (w *Watcher) enqueue(routeID int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.pending[routeID] {
+		return
+	}
+	w.pending[routeID] = true
+	w.queue <- routeID
+}
+
+// Run checks every route at once, then as they are queued by Notify and at each interval,
+// until ctx is cancelled.
+func (w *Watcher) Run(ctx context.Context) {
+	log.Printf("Watching %d routes", len(w.routes))
+	w.enqueueAll()
+	var tick <-chan time.Time
+	if w.conf.Interval > 0 {
+		ticker := time.NewTicker(w.conf.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+			w.enqueueAll()
+		case id := <-w.queue:
+			w.mu.Lock()
+			delete(w.pending, id)
+			w.mu.Unlock()
+			for _, r := range w.routes {
+				if r.ref.ID == id {
+					if err := w.check(ctx, r); err != nil {
+						log.Printf("Error checking watched %s: %v", r.ref, err)
+					}
+				}
+			}
+		}
+	}
+}
+
+func (w *Watcher) enqueueAll() {
+	for _, r := range w.routes {
+		w.enqueue(r.ref.ID)
+	}
+}
+
+// check fetches a route unless it is unchanged since it was last checked, and if it has
+// changed, summarizes it and posts the summary if that has changed too.
+func (w *Watcher) check(ctx context.Context, r *watchedRoute) error {
+	if timeout := w.h.conf.Timeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	w.mu.Lock()
+	prev := w.state[r.key]
+	w.mu.Unlock()
+	var prevTrack *Track
+	if prev != nil {
+		prevTrack = &Track{ETag: prev.ETag, LastModified: prev.LastModified}
+	}
+	t, modified, err := w.h.client.RevalidateTrack(ctx, r.ref, prevTrack)
+	if err != nil {
+		return err
+	}
+	if !modified {
+		return nil
+	}
+	next := &watchState{ETag: t.ETag, LastModified: t.LastModified, Track: trackVersion(t), UpdatedAt: t.Fetched.UTC().Truncate(time.Second)}
+	if lm, err := http.ParseTime(t.LastModified); err == nil {
+		next.UpdatedAt = lm
+	}
+	if prev != nil && prev.Track == next.Track {
+		// The site sent the route again although it has not changed
+		next.Summary, next.UpdatedAt = prev.Summary, prev.UpdatedAt
+		return w.update(r.key, next)
+	}
+	log.Printf("Watched %s changed, summarizing", r.ref)
+	if w.h.cache != nil {
+		w.h.cache.Expire(r.ref)
+	}
+	summary, err := w.h.Summarize(ctx, r.params, t.Data)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	next.Summary = hex.EncodeToString(sum[:])
+	if prev != nil && prev.Summary == next.Summary {
+		log.Printf("Summary of watched %s is unchanged", r.ref)
+		return w.update(r.key, next)
+	}
+	link := summary.Link
+	if link == "" {
+		link = w.h.Link(r.params)
+	}
+	err = w.post(ctx, &Callback{RouteID: r.ref.ID, Params: r.key, Link: link, UpdatedAt: next.UpdatedAt, Summary: summary})
+	if err != nil {
+		// Leave the state alone, so the route is summarized and posted at the next check
+		return err
+	}
+	log.Printf("Posted summary of watched %s", r.ref)
+	return w.update(r.key, next)
+}
+
+// update records the state of a route and saves the state file.
+func (w *Watcher) update(key string, st *watchState) error {
+	w.mu.Lock()
+	w.state[key] = st
+	w.mu.Unlock()
+	return w.save()
+}
+
+// post sends a callback, retrying with exponential backoff if it fails.
+func (w *Watcher) post(ctx context.Context, cb *Callback) error {
+	body, err := json.Marshal(cb)
+	if err != nil {
+		return fmt.Errorf("error marshalling callback: %v", err)
+	}
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		err = w.postOnce(ctx, body)
+		if err == nil || attempt >= w.conf.Retries {
+			return err
+		}
+		log.Printf("Error posting callback (attempt %d): %v", attempt+1, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		delay *= 2
+	}
+}
+
+func (w *Watcher) postOnce(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.callback, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error constructing callback request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gpx-utils")
+	if w.conf.Secret != "" {
+		req.Header.Set("X-Signature-256", "sha256="+sign(w.conf.Secret, body))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error posting callback: %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("error posting callback: %s", resp.Status)
+	}
+	return nil
+}
+
+// sign returns the hex-encoded HMAC-SHA256 of body keyed with secret.
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ServeWebhook queues a check of the route given by the routeId parameter or the routeId
+// field of a JSON body. If the watcher has a secret, the request must present it as a bearer
+// token or in the token parameter.
+func (w *Watcher) ServeWebhook(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		rw.Header().Set("Allow", "POST")
+		writeProblem(rw, http.StatusMethodNotAllowed, "webhooks must be POSTed")
+		return
+	}
+	if w.conf.Secret != "" {
+		token := r.URL.Query().Get("token")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if !hmac.Equal([]byte(token), []byte(w.conf.Secret)) {
+			writeProblem(rw, http.StatusUnauthorized, "invalid or missing token")
+			return
+		}
+	}
+	raw := r.URL.Query().Get("routeId")
+	if raw == "" && strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var body struct {
+			RouteID json.Number `json:"routeId"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&body); err != nil {
+			writeProblem(rw, http.StatusBadRequest, fmt.Sprintf("error decoding JSON: %v", err))
+			return
+		}
+		raw = body.RouteID.String()
+	}
+	id, err := strconv.Atoi(raw)
+	if err != nil || id <= 0 {
+		writeProblem(rw, http.StatusBadRequest, "routeId is required")
+		return
+	}
+	if err := w.Notify(id); err != nil {
+		writeProblem(rw, http.StatusNotFound, fmt.Sprintf("route %d is not watched", id))
+		return
+	}
+	requestid.Printf(r.Context(), "Webhook queued check of route %d", id)
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(rw).Encode(map[string]string{"status": "queued"})
+}
+
+// load reads the state file, if there is one.
+func (w *Watcher) load() error {
+	if w.conf.StateFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(w.conf.StateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("error reading watch state: %v", err)
+	}
+	if err := json.Unmarshal(data, &w.state); err != nil {
+		return fmt.Errorf("error parsing watch state %s: %v", w.conf.StateFile, err)
+	}
+	if w.state == nil {
+		w.state = make(map[string]*watchState)
+	}
+	return nil
+}
+
+// save writes the state file, if there is one.
+func (w *Watcher) save() error {
+	if w.conf.StateFile == "" {
+		return nil
+	}
+	w.mu.Lock()
+	data, err := json.MarshalIndent(w.state, "", "  ")
+	w.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(w.conf.StateFile, data); err != nil {
+		return fmt.Errorf("error writing watch state: %v", err)
+	}
+	return nil
+}
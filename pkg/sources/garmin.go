@@ -0,0 +1,44 @@
+package sources
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+const garminBaseURL = "https://connectapi.garmin.com"
+
+// Garmin fetches courses from Garmin Connect as GPX. The API requires an OAuth AccessToken
+// for the owner of the course.
+type Garmin struct {
+	HTTPClient  *http.Client
+	BaseURL     string
+	AccessToken string
+	MaxSize     int64
+}
+
+func (g *Garmin) Name() string {
+	return "garmin"
+}
+
+// Course URLs look like https://connect.garmin.com/modern/course/123456
+var garminCoursePath = regexp.MustCompile(`^(?:/modern)?/course/(\d+)`)
+
+func (g *Garmin) ParseURL(rawURL string) (string, bool) {
+	return matchURL(rawURL, []string{"connect.garmin.com"}, garminCoursePath)
+}
+
+func (g *Garmin) FetchGPX(ctx context.Context, id string) ([]byte, error) {
+	if !isNumeric(id) {
+		return nil, fmt.Errorf("%w: invalid Garmin course id %q", ErrInvalidID, id)
+	}
+	req, err := newRequest(ctx, g.BaseURL, garminBaseURL, fmt.Sprintf("/course-service/course/gpx/%s", id))
+	if err != nil {
+		return nil, err
+	}
+	if g.AccessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+g.AccessToken)
+	}
+	return newFetcher(g.HTTPClient, g.MaxSize).get(req, g.Name(), id)
+}
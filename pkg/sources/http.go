@@ -0,0 +1,133 @@
+package sources
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DefaultMaxSize is the maximum size (in bytes) of a route when a source has no MaxSize.
+const DefaultMaxSize = 10 << 20
+
+var defaultHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// fetcher holds the HTTP settings common to all sources.
+type fetcher struct {
+	httpClient *http.Client
+	maxSize    int64
+}
+
+func newFetcher(c *http.Client, maxSize int64) fetcher {
+	if c == nil {
+		c = defaultHTTPClient
+	}
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	return fetcher{c, maxSize}
+}
+
+// get sends req and returns the response body, mapping failures to the package errors.
+func (f fetcher) get(req *http.Request, source, id string) ([]byte, error) {
+	req.Header.Set("User-Agent", "gpx-utils")
+	resp, err := f.httpClient.Do(req)
+	if err != nil {
+		if ctxErr := req.Context().Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, fmt.Errorf("%w from %s: %v", ErrUpstream, source, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("%w: %s route %s", ErrNotFound, source, id)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, fmt.Errorf("%w: %s route %s", ErrNotAuthorized, source, id)
+	default:
+		return nil, fmt.Errorf("%w from %s: unexpected status %s", ErrUpstream, source, resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, f.maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w from %s: %v", ErrUpstream, source, err)
+	}
+	if int64(len(data)) > f.maxSize {
+		return nil, fmt.Errorf("%w: %s route %s is more than %d bytes", ErrTooLarge, source, id, f.maxSize)
+	}
+	if !looksLikeGPX(data) {
+		// Services answer some failures, such as an expired login, with a web page
+		return nil, fmt.Errorf("%w from %s: response for route %s is not GPX", ErrUpstream, source, id)
+	}
+	return data, nil
+}
+
+func newRequest(ctx context.Context, baseURL, defaultBaseURL, path string) (*http.Request, error) {
+	if baseURL == "" {
+		baseURL = defaultBaseURL
+	}
+	u := strings.TrimRight(baseURL, "/") + path
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error constructing request for %s: %v", u, err)
+	}
+	return req, nil
+}
+
+// matchURL parses rawURL and, if its host is one of hosts (ignoring any "www." prefix) and
+// its path matches re, returns the first submatch of re.
+func matchURL(rawURL string, hosts []string, re *regexp.Regexp) (string, bool) {
+	s := strings.TrimSpace(rawURL)
+	if !strings.Contains(s, "://") {
+		s = "https://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", false
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	for _, h := range hosts {
+		if host == h {
+			if m := re.FindStringSubmatch(u.Path); m != nil {
+				return m[1], true
+			}
+			return "", false
+		}
+	}
+	return "", false
+}
+
+// looksLikeGPX reports whether data starts with a gpx element, after any XML declaration,
+// comments and whitespace.
+func looksLikeGPX(data []byte) bool {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return false
+		}
+		if el, ok := tok.(xml.StartElement); ok {
+			return el.Name.Local == "gpx"
+		}
+	}
+}
+
+// isNumeric reports whether id is a non-empty string of digits.
+func isNumeric(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, r := range id {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,46 @@
+package sources
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+const komootBaseURL = "https://www.komoot.com"
+
+// Komoot fetches tours from Komoot as GPX. Public tours need no credentials; private tours
+// need the Email and Password of their owner.
+type Komoot struct {
+	HTTPClient *http.Client
+	BaseURL    string
+	Email      string
+	Password   string
+	MaxSize    int64
+}
+
+func (k *Komoot) Name() string {
+	return "komoot"
+}
+
+// Tour URLs look like https://www.komoot.com/tour/123456, optionally with a locale such as
+// /de-de/ before "tour".
+var komootTourPath = regexp.MustCompile(`^(?:/[a-z]{2}-[a-z]{2})?/tour/(\d+)`)
+
+func (k *Komoot) ParseURL(rawURL string) (string, bool) {
+	return matchURL(rawURL, []string{"komoot.com", "komoot.de"}, komootTourPath)
+}
+
+func (k *Komoot) FetchGPX(ctx context.Context, id string) ([]byte, error) {
+	if !isNumeric(id) {
+		return nil, fmt.Errorf("%w: invalid Komoot tour id %q", ErrInvalidID, id)
+	}
+	req, err := newRequest(ctx, k.BaseURL, komootBaseURL, fmt.Sprintf("/api/v007/tours/%s.gpx", id))
+	if err != nil {
+		return nil, err
+	}
+	if k.Email != "" {
+		req.SetBasicAuth(k.Email, k.Password)
+	}
+	return newFetcher(k.HTTPClient, k.MaxSize).get(req, k.Name(), id)
+}
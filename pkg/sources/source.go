@@ -0,0 +1,114 @@
+// Package sources fetches routes in GPX format from route planning services.
+package sources
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+)
+
+// RouteSource fetches routes from a route planning service.
+type RouteSource interface {
+	// Name identifies the source in the source= parameter, e.g. "komoot".
+	Name() string
+	// ParseURL returns the ID of the route at rawURL, or false if the URL does not belong
+	// to this source.
+	ParseURL(rawURL string) (string, bool)
+	// FetchGPX fetches the route with the given ID in GPX format.
+	FetchGPX(ctx context.Context, id string) ([]byte, error)
+}
+
+var (
+	ErrUnknownSource = errors.New("unknown route source")
+	ErrUnknownURL    = errors.New("URL does not belong to a known route source")
+	ErrInvalidID     = errors.New("invalid route id")
+	ErrNotFound      = errors.New("route not found")
+	ErrNotAuthorized = errors.New("not authorized to fetch route")
+	ErrTooLarge      = errors.New("route too large")
+	ErrUpstream      = errors.New("error fetching route")
+)
+
+// Registry holds the route sources known to a program.
+type Registry struct {
+	sources map[string]RouteSource
+}
+
+func NewRegistry(sources ...RouteSource) *Registry {
+	r := &Registry{sources: make(map[string]RouteSource)}
+	for _, s := range sources {
+		r.Register(s)
+	}
+	return r
+}
+
+// Register adds s to the registry, replacing any source with the same name.
+func (r *Registry) Register(s RouteSource) {
+	r.sources[s.Name()] = s
+}
+
+// Get returns the source called name.
+func (r *Registry) Get(name string) (RouteSource, error) {
+	s, ok := r.sources[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownSource, name)
+	}
+	return s, nil
+}
+
+// Names returns the names of the registered sources in alphabetical order.
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.sources))
+	for name := range r.sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ForURL returns the source a route URL belongs to, and the ID of the route.
+func (r *Registry) ForURL(rawURL string) (RouteSource, string, error) {
+	for _, name := range r.Names() {
+		s := r.sources[name]
+		if id, ok := s.ParseURL(rawURL); ok {
+			return s, id, nil
+		}
+	}
+	return nil, "", fmt.Errorf("%w: %s", ErrUnknownURL, rawURL)
+}
+
+// FromEnv returns a registry of the Komoot, Strava and Garmin Connect sources, configured
+// from the environment:
+//
+//	KOMOOT_EMAIL, KOMOOT_PASSWORD   Komoot account, for private tours
+//	STRAVA_ACCESS_TOKEN             Strava OAuth access token with read_all scope
+//	GARMIN_ACCESS_TOKEN             Garmin Connect OAuth access token
+//	KOMOOT_BASE_URL, STRAVA_BASE_URL, GARMIN_BASE_URL override the services' API addresses
+//
+// The sources fetch routes with httpClient, or if it is nil a client with a 30s timeout, and
+// reject routes of more than maxSize bytes, or DefaultMaxSize if it is 0.
+func FromEnv(httpClient *http.Client, maxSize int64) *Registry {
+	return NewRegistry(
+		&Komoot{
+			HTTPClient: httpClient,
+			BaseURL:    os.Getenv("KOMOOT_BASE_URL"),
+			Email:      os.Getenv("KOMOOT_EMAIL"),
+			Password:   os.Getenv("KOMOOT_PASSWORD"),
+			MaxSize:    maxSize,
+		},
+		&Strava{
+			HTTPClient:  httpClient,
+			BaseURL:     os.Getenv("STRAVA_BASE_URL"),
+			AccessToken: os.Getenv("STRAVA_ACCESS_TOKEN"),
+			MaxSize:     maxSize,
+		},
+		&Garmin{
+			HTTPClient:  httpClient,
+			BaseURL:     os.Getenv("GARMIN_BASE_URL"),
+			AccessToken: os.Getenv("GARMIN_ACCESS_TOKEN"),
+			MaxSize:     maxSize,
+		},
+	)
+}
@@ -0,0 +1,275 @@
+package sources
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// response is a recorded response replayed by the test server.
+type response struct {
+	status      int
+	file        string // in testdata, empty for no body
+	contentType string
+}
+
+// replayServer serves the recorded responses by request path, and 404 for other paths. It
+// keeps the requests it receives so that tests can check their headers.
+type replayServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+func newReplayServer(t *testing.T, responses map[string]response) *replayServer {
+	t.Helper()
+	s := &replayServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests = append(s.requests, r)
+		s.mu.Unlock()
+		res, ok := responses[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if res.contentType != "" {
+			w.Header().Set("Content-Type", res.contentType)
+		}
+		w.WriteHeader(res.status)
+		if res.file != "" {
+			data, err := ioutil.ReadFile(filepath.Join("testdata", res.file))
+			if err != nil {
+				t.Errorf("error reading fixture: %v", err)
+				return
+			}
+			w.Write(data)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *replayServer) lastRequest() *http.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.requests) == 0 {
+		return nil
+	}
+	return s.requests[len(s.requests)-1]
+}
+
+func (s *replayServer) requestCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.requests)
+}
+
+// sourceFixture describes how a source is tested: its constructor, the API path of a route,
+// its recorded responses and the credentials it should send.
+type sourceFixture struct {
+	name      string
+	newSource func(baseURL string, maxSize int64) RouteSource
+	path      string // format of the path with the route ID
+	gpx       string
+	forbidden response
+	notFound  response
+	checkAuth func(r *http.Request) error
+}
+
+var sourceFixtures = []sourceFixture{
+	{
+		name: "komoot",
+		newSource: func(baseURL string, maxSize int64) RouteSource {
+			return &Komoot{BaseURL: baseURL, Email: "rider@example.org", Password: "pa55", MaxSize: maxSize}
+		},
+		path:      "/api/v007/tours/%s.gpx",
+		gpx:       "komoot-tour.gpx",
+		forbidden: response{http.StatusForbidden, "komoot-403.json", "application/hal+json"},
+		notFound:  response{http.StatusNotFound, "komoot-404.json", "application/hal+json"},
+		checkAuth: func(r *http.Request) error {
+			if user, pass, ok := r.BasicAuth(); !ok || user != "rider@example.org" || pass != "pa55" {
+				return fmt.Errorf("got basic auth %q %q %v, want the account credentials", user, pass, ok)
+			}
+			return nil
+		},
+	},
+	{
+		name: "strava",
+		newSource: func(baseURL string, maxSize int64) RouteSource {
+			return &Strava{BaseURL: baseURL, AccessToken: "strava-token", MaxSize: maxSize}
+		},
+		path:      "/api/v3/routes/%s/export_gpx",
+		gpx:       "strava-route.gpx",
+		forbidden: response{http.StatusUnauthorized, "strava-401.json", "application/json"},
+		notFound:  response{http.StatusNotFound, "strava-404.json", "application/json"},
+		checkAuth: bearer("strava-token"),
+	},
+	{
+		name: "garmin",
+		newSource: func(baseURL string, maxSize int64) RouteSource {
+			return &Garmin{BaseURL: baseURL, AccessToken: "garmin-token", MaxSize: maxSize}
+		},
+		path:      "/course-service/course/gpx/%s",
+		gpx:       "garmin-course.gpx",
+		forbidden: response{http.StatusForbidden, "garmin-403.json", "application/json"},
+		notFound:  response{http.StatusNotFound, "garmin-404.json", "application/json"},
+		checkAuth: bearer("garmin-token"),
+	},
+}
+
+func bearer(token string) func(r *http.Request) error {
+	return func(r *http.Request) error {
+		if got := r.Header.Get("Authorization"); got != "Bearer "+token {
+			return fmt.Errorf("got Authorization %q, want bearer token", got)
+		}
+		return nil
+	}
+}
+
+func TestFetchGPX(t *testing.T) {
+	for _, f := range sourceFixtures {
+		f := f
+		t.Run(f.name, func(t *testing.T) {
+			srv := newReplayServer(t, map[string]response{
+				fmt.Sprintf(f.path, "1001"): {http.StatusOK, f.gpx, "application/gpx+xml"},
+				fmt.Sprintf(f.path, "1002"): f.forbidden,
+				fmt.Sprintf(f.path, "1003"): f.notFound,
+				fmt.Sprintf(f.path, "1004"): {http.StatusOK, "login.html", "text/html; charset=utf-8"},
+				fmt.Sprintf(f.path, "1005"): {http.StatusServiceUnavailable, "", ""},
+			})
+			src := f.newSource(srv.URL, 0)
+			ctx := context.Background()
+
+			want, err := ioutil.ReadFile(filepath.Join("testdata", f.gpx))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := src.FetchGPX(ctx, "1001")
+			if err != nil {
+				t.Fatalf("FetchGPX: %v", err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("FetchGPX returned %d bytes, want the %d bytes of %s", len(got), len(want), f.gpx)
+			}
+			if err := f.checkAuth(srv.lastRequest()); err != nil {
+				t.Error(err)
+			}
+			if ua := srv.lastRequest().Header.Get("User-Agent"); ua != "gpx-utils" {
+				t.Errorf("got User-Agent %q, want gpx-utils", ua)
+			}
+
+			for _, tc := range []struct {
+				name string
+				id   string
+				want error
+			}{
+				{"private", "1002", ErrNotAuthorized},
+				{"not found", "1003", ErrNotFound},
+				{"malformed", "1004", ErrUpstream},
+				{"unavailable", "1005", ErrUpstream},
+			} {
+				if _, err := src.FetchGPX(ctx, tc.id); !errors.Is(err, tc.want) {
+					t.Errorf("%s: got error %v, want %v", tc.name, err, tc.want)
+				}
+			}
+
+			n := srv.requestCount()
+			if _, err := src.FetchGPX(ctx, "12ab"); !errors.Is(err, ErrInvalidID) {
+				t.Errorf("invalid id: got error %v, want %v", err, ErrInvalidID)
+			}
+			if srv.requestCount() != n {
+				t.Error("invalid id: request sent to the service")
+			}
+
+			small := f.newSource(srv.URL, int64(len(want)-1))
+			if _, err := small.FetchGPX(ctx, "1001"); !errors.Is(err, ErrTooLarge) {
+				t.Errorf("too large: got error %v, want %v", err, ErrTooLarge)
+			}
+		})
+	}
+}
+
+func TestFromEnvMaxSize(t *testing.T) {
+	responses := make(map[string]response)
+	for _, f := range sourceFixtures {
+		responses["/"+f.name+fmt.Sprintf(f.path, "1001")] = response{http.StatusOK, f.gpx, "application/gpx+xml"}
+	}
+	srv := newReplayServer(t, responses)
+	for _, name := range []string{"KOMOOT", "STRAVA", "GARMIN"} {
+		t.Setenv(name+"_BASE_URL", srv.URL+"/"+strings.ToLower(name))
+	}
+	ctx := context.Background()
+	for _, tc := range []struct {
+		maxSize int64
+		want    error
+	}{
+		{0, nil},
+		{100, ErrTooLarge},
+	} {
+		registry := FromEnv(nil, tc.maxSize)
+		for _, f := range sourceFixtures {
+			src, err := registry.Get(f.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := src.FetchGPX(ctx, "1001"); !errors.Is(err, tc.want) {
+				t.Errorf("%s with max size %d: got error %v, want %v", f.name, tc.maxSize, err, tc.want)
+			}
+		}
+	}
+}
+
+func TestFetchGPXCancelled(t *testing.T) {
+	srv := newReplayServer(t, map[string]response{
+		"/api/v3/routes/1001/export_gpx": {http.StatusOK, "strava-route.gpx", "application/gpx+xml"},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := (&Strava{BaseURL: srv.URL}).FetchGPX(ctx, "1001")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestParseURL(t *testing.T) {
+	r := NewRegistry(&Komoot{}, &Strava{}, &Garmin{})
+	tests := []struct {
+		url    string
+		source string
+		id     string
+	}{
+		{"https://www.komoot.com/tour/123456", "komoot", "123456"},
+		{"https://www.komoot.de/de-de/tour/123456?ref=wtd", "komoot", "123456"},
+		{"komoot.com/tour/42", "komoot", "42"},
+		{"https://www.strava.com/routes/3141592653589793238", "strava", "3141592653589793238"},
+		{"https://connect.garmin.com/modern/course/98765", "garmin", "98765"},
+		{"https://connect.garmin.com/course/98765", "garmin", "98765"},
+		{"https://www.komoot.com/collection/123", "", ""},
+		{"https://www.strava.com/activities/123", "", ""},
+		{"https://example.com/tour/123", "", ""},
+	}
+	for _, tc := range tests {
+		src, id, err := r.ForURL(tc.url)
+		if tc.source == "" {
+			if !errors.Is(err, ErrUnknownURL) {
+				t.Errorf("ForURL(%q) = %v, %q, %v; want %v", tc.url, src, id, err, ErrUnknownURL)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ForURL(%q): %v", tc.url, err)
+			continue
+		}
+		if src.Name() != tc.source || id != tc.id {
+			t.Errorf("ForURL(%q) = %s %q, want %s %q", tc.url, src.Name(), id, tc.source, tc.id)
+		}
+	}
+}
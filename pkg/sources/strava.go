@@ -0,0 +1,44 @@
+package sources
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+const stravaBaseURL = "https://www.strava.com"
+
+// Strava fetches routes from Strava as GPX. The API requires an OAuth AccessToken, with
+// read_all scope for private routes.
+type Strava struct {
+	HTTPClient  *http.Client
+	BaseURL     string
+	AccessToken string
+	MaxSize     int64
+}
+
+func (s *Strava) Name() string {
+	return "strava"
+}
+
+// Route URLs look like https://www.strava.com/routes/123456
+var stravaRoutePath = regexp.MustCompile(`^/routes/(\d+)`)
+
+func (s *Strava) ParseURL(rawURL string) (string, bool) {
+	return matchURL(rawURL, []string{"strava.com"}, stravaRoutePath)
+}
+
+func (s *Strava) FetchGPX(ctx context.Context, id string) ([]byte, error) {
+	if !isNumeric(id) {
+		return nil, fmt.Errorf("%w: invalid Strava route id %q", ErrInvalidID, id)
+	}
+	req, err := newRequest(ctx, s.BaseURL, stravaBaseURL, fmt.Sprintf("/api/v3/routes/%s/export_gpx", id))
+	if err != nil {
+		return nil, err
+	}
+	if s.AccessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.AccessToken)
+	}
+	return newFetcher(s.HTTPClient, s.MaxSize).get(req, s.Name(), id)
+}
@@ -0,0 +1,117 @@
+package track
+
+import (
+	"fmt"
+	"time"
+)
+
+// Concat joins tracks end to end.
+func Concat(tracks ...[]Point) []Point {
+	var result []Point
+	for _, t := range tracks {
+		result = append(result, t...)
+	}
+	UpdateDistances(result)
+	return result
+}
+
+// Split divides a track at distance d (in metres). The point at d is included in both halves.
+// It is an error for d not to lie strictly between the start and end of the track.
+func Split(points []Point, d float64) ([]Point, []Point, error) {
+	if len(points) < 2 {
+		return nil, nil, fmt.Errorf("cannot split a track of %d points", len(points))
+	}
+	total := points[len(points)-1].Distance
+	if d <= 0 || d >= total {
+		return nil, nil, fmt.Errorf("split point %0.2f km is not within the track (0 to %0.2f km)", d/1000.0, total/1000.0)
+	}
+	first, second := split(points, d)
+	return first, second, nil
+}
+
+func split(points []Point, d float64) ([]Point, []Point) {
+	if len(points) == 0 {
+		return nil, nil
+	}
+	i := 0
+	for i < len(points)-1 && points[i+1].Distance < d {
+		i++
+	}
+	if i == len(points)-1 {
+		return Concat(points), nil
+	}
+	p := interpolate(points[i], points[i+1], d)
+	first := append(append([]Point{}, points[:i+1]...), p)
+	second := append([]Point{p}, points[i+1:]...)
+	UpdateDistances(first)
+	UpdateDistances(second)
+	return first, second
+}
+
+// Trim discards start metres from the beginning of the track and end metres from the end.
+func Trim(points []Point, start, end float64) []Point {
+	if len(points) == 0 {
+		return nil
+	}
+	total := points[len(points)-1].Distance
+	if start+end >= total {
+		return nil
+	}
+	result := points
+	if start > 0 {
+		_, result = split(result, start)
+	}
+	if end > 0 {
+		result, _ = split(result, total-start-end)
+	}
+	return Concat(result)
+}
+
+// TrimTime discards points recorded in the first start and the last end of the track. Points
+// without a timestamp are retained.
+func TrimTime(points []Point, start, end time.Duration) []Point {
+	var t0, t1 time.Time
+	for _, p := range points {
+		if p.Time.IsZero() {
+			continue
+		}
+		if t0.IsZero() {
+			t0 = p.Time
+		}
+		t1 = p.Time
+	}
+	from, to := t0.Add(start), t1.Add(-end)
+	var result []Point
+	for _, p := range points {
+		if p.Time.IsZero() || (!p.Time.Before(from) && !p.Time.After(to)) {
+			result = append(result, p)
+		}
+	}
+	return Concat(result)
+}
+
+// Reverse returns the track in the opposite direction. Timestamps are mirrored so that they
+// still increase along the track, with the same intervals between points.
+func Reverse(points []Point) []Point {
+	result := make([]Point, len(points))
+	for i, p := range points {
+		result[len(points)-1-i] = p
+	}
+	// Mirror between the first and last timestamps, which need not be at the ends of the track
+	var t0, t1 time.Time
+	for _, p := range points {
+		if !p.Time.IsZero() {
+			if t0.IsZero() {
+				t0 = p.Time
+			}
+			t1 = p.Time
+		}
+	}
+	for i := range result {
+		if !result[i].Time.IsZero() {
+			result[i].Time = t0.Add(t1.Sub(result[i].Time))
+		}
+	}
+	UpdateDistances(result)
+	return result
+}
@@ -0,0 +1,29 @@
+package track
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReverse(t *testing.T) {
+	start := time.Date(2025, 6, 1, 10, 0, 0, 0, time.UTC)
+	points := line([2]float64{0, 0}, [2]float64{10, 0}, [2]float64{30, 0}, [2]float64{60, 0})
+	// The last point has no timestamp, as when a route planner closes a loop
+	for i, offset := range []time.Duration{0, 10 * time.Second, 30 * time.Second} {
+		points[i].Time = start.Add(offset)
+	}
+	got := Reverse(points)
+	if len(got) != len(points) {
+		t.Fatalf("got %d points, want %d", len(got), len(points))
+	}
+	wantEasting := []float64{60, 30, 10, 0}
+	wantTime := []time.Time{{}, start, start.Add(20 * time.Second), start.Add(30 * time.Second)}
+	for i, p := range got {
+		if p.Easting != wantEasting[i] || !p.Time.Equal(wantTime[i]) {
+			t.Errorf("point %d: got easting %.f at %s, want %.f at %s", i, p.Easting, p.Time, wantEasting[i], wantTime[i])
+		}
+	}
+	if d := got[len(got)-1].Distance; d != 60 {
+		t.Errorf("got distance %.f at the end of the reversed track, want 60", d)
+	}
+}
@@ -0,0 +1,44 @@
+package track
+
+import "time"
+
+// Resample returns points spaced interval metres apart along the track, interpolating
+// position, elevation and time. The last point of the track is always included.
+func Resample(points []Point, interval float64) []Point {
+	if len(points) < 2 || interval <= 0 {
+		return points
+	}
+	total := points[len(points)-1].Distance
+	result := []Point{points[0]}
+	j := 0
+	for d := interval; d < total; d += interval {
+		for points[j+1].Distance < d {
+			j++
+		}
+		result = append(result, interpolate(points[j], points[j+1], d))
+	}
+	result = append(result, points[len(points)-1])
+	UpdateDistances(result)
+	return result
+}
+
+// interpolate returns the point on the segment from p to q at distance d along the track.
+func interpolate(p, q Point, d float64) Point {
+	f := 0.0
+	if q.Distance > p.Distance {
+		f = (d - p.Distance) / (q.Distance - p.Distance)
+	}
+	lerp := func(x, y float64) float64 { return x + f*(y-x) }
+	r := Point{
+		Lat:      lerp(p.Lat, q.Lat),
+		Lon:      lerp(p.Lon, q.Lon),
+		Ele:      lerp(p.Ele, q.Ele),
+		Easting:  lerp(p.Easting, q.Easting),
+		Northing: lerp(p.Northing, q.Northing),
+		Distance: d,
+	}
+	if !p.Time.IsZero() && !q.Time.IsZero() {
+		r.Time = p.Time.Add(time.Duration(f * float64(q.Time.Sub(p.Time))))
+	}
+	return r
+}
@@ -0,0 +1,66 @@
+package track
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestResample(t *testing.T) {
+	start := time.Date(2025, 6, 1, 10, 0, 0, 0, time.UTC)
+	points := line([2]float64{0, 0}, [2]float64{30, 0}, [2]float64{95, 0})
+	for i, p := range points {
+		points[i].Time = start.Add(time.Duration(p.Distance) * time.Second)
+		points[i].Ele = p.Distance / 10
+	}
+	got := Resample(points, 10)
+	if len(got) != 11 {
+		t.Fatalf("got %d points, want 11", len(got))
+	}
+	for i, p := range got[:10] {
+		d := 10 * float64(i)
+		if math.Abs(p.Easting-d) > 1e-9 || math.Abs(p.Distance-d) > 1e-9 || math.Abs(p.Ele-d/10) > 1e-9 {
+			t.Errorf("point %d: got %+v, want %.f m along the track", i, p, d)
+		}
+		if want := start.Add(time.Duration(d) * time.Second); !p.Time.Equal(want) {
+			t.Errorf("point %d: got time %s, want %s", i, p.Time, want)
+		}
+	}
+	if last := got[10]; last != points[2] {
+		t.Errorf("got last point %+v, want %+v", last, points[2])
+	}
+}
+
+func TestResampleDegenerate(t *testing.T) {
+	a, b := [2]float64{0, 0}, [2]float64{100, 0}
+	tests := []struct {
+		name     string
+		points   []Point
+		interval float64
+		want     int
+	}{
+		{"empty", nil, 10, 0},
+		{"one point", line(a), 10, 1},
+		{"two points", line(a, b), 10, 11},
+		{"two identical points", line(a, a), 10, 2},
+		{"duplicates", line(a, a, [2]float64{50, 0}, [2]float64{50, 0}, b, b), 10, 11},
+		{"interval longer than the track", line(a, b), 500, 2},
+		{"zero interval", line(a, b), 0, 2},
+		{"negative interval", line(a, b), -10, 2},
+	}
+	for _, tc := range tests {
+		got := Resample(tc.points, tc.interval)
+		if len(got) != tc.want {
+			t.Errorf("%s: got %d points, want %d", tc.name, len(got), tc.want)
+			continue
+		}
+		for i := 1; i < len(got); i++ {
+			if step := got[i].Distance - got[i-1].Distance; tc.interval > 0 && step > tc.interval+1e-9 {
+				t.Errorf("%s: %.1f m between points %d and %d", tc.name, step, i-1, i)
+			}
+		}
+		if len(got) > 0 && (got[0] != tc.points[0] || got[len(got)-1] != tc.points[len(tc.points)-1]) {
+			t.Errorf("%s: endpoints not retained: %+v", tc.name, got)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package track
+
+import "math"
+
+// Hausdorff returns the Hausdorff distance (in metres) between two tracks: the greatest
+// distance from a point on either track to the nearest point on the other. It does not
+// depend on the direction of travel. Tracks should be resampled or simplified first, as the
+// cost is proportional to the product of their lengths.
+func Hausdorff(a, b []Point) float64 {
+	return math.Max(directedHausdorff(a, b, math.Inf(1)), directedHausdorff(b, a, math.Inf(1)))
+}
+
+// HausdorffWithin reports whether the Hausdorff distance between two tracks is at most
+// threshold metres. It is faster than Hausdorff for dissimilar tracks.
+func HausdorffWithin(a, b []Point, threshold float64) bool {
+	return directedHausdorff(a, b, threshold) <= threshold && directedHausdorff(b, a, threshold) <= threshold
+}
+
+// directedHausdorff returns the greatest distance from a point in a to its nearest point in
+// b, or a value greater than limit as soon as one is found.
+func directedHausdorff(a, b []Point, limit float64) float64 {
+	max := 0.0
+	for _, p := range a {
+		nearest := math.Inf(1)
+		for i := range b {
+			if i > 0 {
+				nearest = math.Min(nearest, segmentDistance(p, b[i-1], b[i]))
+			} else if len(b) == 1 {
+				nearest = Distance(p, b[0])
+			}
+			if nearest <= max {
+				break
+			}
+		}
+		if nearest > max {
+			max = nearest
+			if max > limit {
+				return max
+			}
+		}
+	}
+	return max
+}
+
+// Frechet returns the discrete Fréchet distance (in metres) between two tracks. Unlike the
+// Hausdorff distance, it takes account of the order in which points are visited, so a route
+// and its reverse are far apart.
+func Frechet(a, b []Point) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return math.Inf(1)
+	}
+	prev := make([]float64, len(b))
+	cur := make([]float64, len(b))
+	for i := range a {
+		for j := range b {
+			d := Distance(a[i], b[j])
+			switch {
+			case i == 0 && j == 0:
+				cur[j] = d
+			case i == 0:
+				cur[j] = math.Max(cur[j-1], d)
+			case j == 0:
+				cur[j] = math.Max(prev[j], d)
+			default:
+				cur[j] = math.Max(math.Min(math.Min(prev[j], prev[j-1]), cur[j-1]), d)
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)-1]
+}
@@ -0,0 +1,189 @@
+package track
+
+import (
+	"container/heap"
+	"math"
+)
+
+// DouglasPeucker simplifies a track using the Douglas-Peucker algorithm, discarding points
+// that lie within tolerance metres of the simplified line. The first and last points are
+// always retained.
+func DouglasPeucker(points []Point, tolerance float64) []Point {
+	if len(points) < 3 {
+		return points
+	}
+	keep := make([]bool, len(points))
+	keep[0], keep[len(points)-1] = true, true
+	douglasPeucker(points, 0, len(points)-1, tolerance, keep)
+	return selectPoints(points, keep)
+}
+
+func douglasPeucker(points []Point, first, last int, tolerance float64, keep []bool) {
+	if last-first < 2 {
+		return
+	}
+	i, d := farthestPoint(points, first, last)
+	if d <= tolerance {
+		return
+	}
+	keep[i] = true
+	douglasPeucker(points, first, i, tolerance, keep)
+	douglasPeucker(points, i, last, tolerance, keep)
+}
+
+// farthestPoint returns the index of the point between first and last that lies farthest
+// from the line joining them, and its distance from that line.
+func farthestPoint(points []Point, first, last int) (int, float64) {
+	index, max := first, -1.0
+	for i := first + 1; i < last; i++ {
+		if d := segmentDistance(points[i], points[first], points[last]); d > max {
+			index, max = i, d
+		}
+	}
+	return index, max
+}
+
+// DouglasPeuckerCount simplifies a track to at most n points (n >= 2), retaining the
+// points the Douglas-Peucker algorithm would add first.
+func DouglasPeuckerCount(points []Point, n int) []Point {
+	if n < 2 {
+		n = 2
+	}
+	if len(points) <= n {
+		return points
+	}
+	type span struct {
+		first, last, farthest int
+		dist                  float64
+	}
+	newSpan := func(first, last int) span {
+		i, d := farthestPoint(points, first, last)
+		return span{first, last, i, d}
+	}
+	keep := make([]bool, len(points))
+	keep[0], keep[len(points)-1] = true, true
+	spans := []span{newSpan(0, len(points)-1)}
+	for kept := 2; kept < n; kept++ {
+		best := -1
+		for i, s := range spans {
+			if s.last-s.first >= 2 && (best < 0 || s.dist > spans[best].dist) {
+				best = i
+			}
+		}
+		if best < 0 {
+			break
+		}
+		s := spans[best]
+		keep[s.farthest] = true
+		spans[best] = newSpan(s.first, s.farthest)
+		spans = append(spans, newSpan(s.farthest, s.last))
+	}
+	return selectPoints(points, keep)
+}
+
+// Visvalingam simplifies a track using the Visvalingam-Whyatt algorithm, repeatedly
+// discarding the point that forms the triangle of least area with its neighbours until
+// every remaining triangle has an area of at least tolerance² square metres. If n > 0,
+// points are also discarded until at most n remain.
+func Visvalingam(points []Point, tolerance float64, n int) []Point {
+	if len(points) < 3 {
+		return points
+	}
+	prev := make([]int, len(points))
+	next := make([]int, len(points))
+	h := make(vwHeap, 0, len(points)-2)
+	items := make([]*vwItem, len(points))
+	for i := range points {
+		prev[i], next[i] = i-1, i+1
+		if i > 0 && i < len(points)-1 {
+			items[i] = &vwItem{index: i, area: triangleArea(points[i-1], points[i], points[i+1])}
+			h = append(h, items[i])
+		}
+	}
+	heap.Init(&h)
+	keep := make([]bool, len(points))
+	for i := range keep {
+		keep[i] = true
+	}
+	remaining := len(points)
+	minArea := tolerance * tolerance
+	for h.Len() > 0 {
+		item := h[0]
+		if item.area >= minArea && (n <= 0 || remaining <= n) {
+			break
+		}
+		heap.Pop(&h)
+		keep[item.index] = false
+		remaining--
+		p, q := prev[item.index], next[item.index]
+		next[p], prev[q] = q, p
+		// Neighbours' areas never decrease below the area of the point just removed,
+		// so that points are eliminated in order of significance.
+		for _, j := range []int{p, q} {
+			if items[j] == nil {
+				continue
+			}
+			items[j].area = math.Max(item.area, triangleArea(points[prev[j]], points[j], points[next[j]]))
+			heap.Fix(&h, items[j].pos)
+		}
+	}
+	return selectPoints(points, keep)
+}
+
+type vwItem struct {
+	index int
+	area  float64
+	pos   int
+}
+
+type vwHeap []*vwItem
+
+func (h vwHeap) Len() int { return len(h) }
+
+func (h vwHeap) Less(i, j int) bool { return h[i].area < h[j].area }
+
+func (h vwHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].pos = i
+	h[j].pos = j
+}
+
+func (h *vwHeap) Push(x interface{}) {
+	item := x.(*vwItem)
+	item.pos = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *vwHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+func selectPoints(points []Point, keep []bool) []Point {
+	var result []Point
+	for i, p := range points {
+		if keep[i] {
+			result = append(result, p)
+		}
+	}
+	UpdateDistances(result)
+	return result
+}
+
+// segmentDistance returns the distance (in metres) from p to the line segment from a to b.
+func segmentDistance(p, a, b Point) float64 {
+	dx, dy := b.Easting-a.Easting, b.Northing-a.Northing
+	l2 := dx*dx + dy*dy
+	if l2 == 0 {
+		return Distance(p, a)
+	}
+	t := ((p.Easting-a.Easting)*dx + (p.Northing-a.Northing)*dy) / l2
+	t = math.Max(0, math.Min(1, t))
+	return math.Hypot(p.Easting-(a.Easting+t*dx), p.Northing-(a.Northing+t*dy))
+}
+
+func triangleArea(a, b, c Point) float64 {
+	return math.Abs((b.Easting-a.Easting)*(c.Northing-a.Northing)-(c.Easting-a.Easting)*(b.Northing-a.Northing)) / 2
+}
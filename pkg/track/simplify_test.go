@@ -0,0 +1,149 @@
+package track
+
+import (
+	"math"
+	"testing"
+)
+
+// line returns a track through the given (easting, northing) positions.
+func line(positions ...[2]float64) []Point {
+	points := make([]Point, len(positions))
+	for i, pos := range positions {
+		points[i] = Point{Easting: pos[0], Northing: pos[1]}
+	}
+	UpdateDistances(points)
+	return points
+}
+
+// wiggly returns a track of n points 10 m apart heading east, weaving up to 50 m either side.
+func wiggly(n int) []Point {
+	var positions [][2]float64
+	for i := 0; i < n; i++ {
+		x := 10 * float64(i)
+		positions = append(positions, [2]float64{x, 50 * math.Sin(x/70) * math.Cos(x/230)})
+	}
+	return line(positions...)
+}
+
+// simplifiers are the simplification algorithms with parameters that discard some but not all
+// points of wiggly(100).
+var simplifiers = []struct {
+	name     string
+	simplify func([]Point) []Point
+}{
+	{"DouglasPeucker", func(points []Point) []Point { return DouglasPeucker(points, 5) }},
+	{"DouglasPeuckerCount", func(points []Point) []Point { return DouglasPeuckerCount(points, 10) }},
+	{"Visvalingam", func(points []Point) []Point { return Visvalingam(points, 10, 0) }},
+	{"VisvalingamCount", func(points []Point) []Point { return Visvalingam(points, 0, 10) }},
+}
+
+func TestSimplifyKeepsEndpoints(t *testing.T) {
+	points := wiggly(100)
+	for _, s := range simplifiers {
+		got := s.simplify(points)
+		if len(got) < 3 || len(got) >= len(points) {
+			t.Errorf("%s kept %d of %d points", s.name, len(got), len(points))
+			continue
+		}
+		first, last := got[0], got[len(got)-1]
+		if first != points[0] {
+			t.Errorf("%s: got first point %+v, want %+v", s.name, first, points[0])
+		}
+		if last.Easting != points[len(points)-1].Easting || last.Northing != points[len(points)-1].Northing {
+			t.Errorf("%s: got last point %+v, want %+v", s.name, last, points[len(points)-1])
+		}
+		if want := got[len(got)-2].Distance + Distance(got[len(got)-2], last); last.Distance != want {
+			t.Errorf("%s: got distance %.1f at the end of the simplified track, want %.1f", s.name, last.Distance, want)
+		}
+	}
+}
+
+func TestSimplifyDegenerate(t *testing.T) {
+	a, b := [2]float64{0, 0}, [2]float64{100, 0}
+	tests := []struct {
+		name   string
+		points []Point
+		want   int
+	}{
+		{"empty", nil, 0},
+		{"one point", line(a), 1},
+		{"two points", line(a, b), 2},
+		{"two identical points", line(a, a), 2},
+		{"collinear", line(a, [2]float64{25, 0}, [2]float64{50, 0}, [2]float64{75, 0}, b), 2},
+		{"duplicates", line(a, a, a, b, b), 2},
+		{"closed loop", line(a, [2]float64{50, 50}, b, [2]float64{50, -50}, a), 5},
+	}
+	for _, tc := range tests {
+		for _, s := range []struct {
+			name     string
+			simplify func([]Point) []Point
+		}{
+			{"DouglasPeucker", func(points []Point) []Point { return DouglasPeucker(points, 1) }},
+			{"Visvalingam", func(points []Point) []Point { return Visvalingam(points, 1, 0) }},
+		} {
+			got := s.simplify(tc.points)
+			if len(got) != tc.want {
+				t.Errorf("%s of %s: got %d points, want %d", s.name, tc.name, len(got), tc.want)
+				continue
+			}
+			if len(got) > 0 && (got[0] != tc.points[0] || got[len(got)-1].Easting != tc.points[len(tc.points)-1].Easting) {
+				t.Errorf("%s of %s: endpoints not retained: %+v", s.name, tc.name, got)
+			}
+		}
+		if got := DouglasPeuckerCount(tc.points, 3); len(got) > 3 || len(got) > len(tc.points) {
+			t.Errorf("DouglasPeuckerCount of %s: got %d points, want at most 3", tc.name, len(got))
+		}
+	}
+}
+
+func TestDouglasPeucker(t *testing.T) {
+	apex := [2]float64{50, 20}
+	points := line([2]float64{0, 0}, [2]float64{25, 10}, apex, [2]float64{75, 10}, [2]float64{100, 0})
+	got := DouglasPeucker(points, 5)
+	if len(got) != 3 || got[1].Easting != apex[0] || got[1].Northing != apex[1] {
+		t.Errorf("got %+v, want the ends and the apex", got)
+	}
+	if got := DouglasPeucker(points, 25); len(got) != 2 {
+		t.Errorf("tolerance above the apex height: got %d points, want 2", len(got))
+	}
+}
+
+func TestSimplifyCount(t *testing.T) {
+	points := wiggly(100)
+	for _, n := range []int{2, 3, 10, 50, 99, 100} {
+		if got := DouglasPeuckerCount(points, n); len(got) != n {
+			t.Errorf("DouglasPeuckerCount(%d): got %d points", n, len(got))
+		}
+		if got := Visvalingam(points, 0, n); len(got) != n {
+			t.Errorf("Visvalingam(0, %d): got %d points", n, len(got))
+		}
+	}
+	for _, n := range []int{-1, 0, 1} {
+		if got := DouglasPeuckerCount(points, n); len(got) != 2 {
+			t.Errorf("DouglasPeuckerCount(%d): got %d points, want 2", n, len(got))
+		}
+	}
+	if got := DouglasPeuckerCount(points, 200); len(got) != len(points) {
+		t.Errorf("DouglasPeuckerCount(200): got %d points, want all %d", len(got), len(points))
+	}
+	// The tolerance still applies when the track already has fewer than n points.
+	if got := Visvalingam(points, 10, 1000); len(got) >= len(points) {
+		t.Errorf("Visvalingam(10, 1000): kept all %d points", len(got))
+	}
+	// The points kept by the Douglas-Peucker algorithm come in order of significance.
+	few, more := DouglasPeuckerCount(points, 5), DouglasPeuckerCount(points, 10)
+	for _, p := range few {
+		if !contains(more, p) {
+			t.Errorf("point %+v kept in 5 but not in 10", p)
+		}
+	}
+}
+
+func contains(points []Point, p Point) bool {
+	for _, q := range points {
+		if q.Easting == p.Easting && q.Northing == p.Northing {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package track
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+
+	"github.com/fofanov/go-osgb"
+	"github.com/twpayne/go-gpx"
+)
+
+// Point is a track point with its National Grid coordinates and distance (in metres) from
+// the start of the track.
+type Point struct {
+	Lat      float64
+	Lon      float64
+	Ele      float64
+	Time     time.Time
+	Easting  float64
+	Northing float64
+	Distance float64
+}
+
+// FromGPX returns the points of all tracks and segments in g as a single track.
+func FromGPX(g *gpx.GPX, trans osgb.CoordinateTransformer) ([]Point, error) {
+	var points []Point
+	for _, trk := range g.Trk {
+		for _, seg := range trk.TrkSeg {
+			for _, p := range seg.TrkPt {
+				ngCoord, err := trans.ToNationalGrid(osgb.NewETRS89Coord(p.Lon, p.Lat, p.Ele))
+				if err != nil {
+					return nil, fmt.Errorf("error converting coordinates to National Grid: %v", err)
+				}
+				points = append(points, Point{
+					Lat:      p.Lat,
+					Lon:      p.Lon,
+					Ele:      p.Ele,
+					Time:     p.Time,
+					Easting:  ngCoord.Easting,
+					Northing: ngCoord.Northing,
+				})
+			}
+		}
+	}
+	UpdateDistances(points)
+	return points, nil
+}
+
+// ReadFile reads a GPX file and returns the parsed GPX along with its track points.
+func ReadFile(filename string) (*gpx.GPX, []Point, error) {
+	r, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening %s for reading: %v", filename, err)
+	}
+	defer r.Close()
+	g, err := gpx.Read(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading GPS track %s: %v", filename, err)
+	}
+	trans, err := osgb.NewOSTN15Transformer()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error constructing coordinate transformer: %v", err)
+	}
+	points, err := FromGPX(g, trans)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading GPS track %s: %v", filename, err)
+	}
+	return g, points, nil
+}
+
+// ToGPX returns a GPX document with a single track containing points. If metadata is nil,
+// metadata containing just the name is created.
+func ToGPX(name string, metadata *gpx.MetadataType, points []Point) *gpx.GPX {
+	if metadata == nil {
+		metadata = &gpx.MetadataType{Name: name}
+	}
+	seg := &gpx.TrkSegType{TrkPt: make([]*gpx.WptType, len(points))}
+	for i, p := range points {
+		seg.TrkPt[i] = &gpx.WptType{Lat: p.Lat, Lon: p.Lon, Ele: p.Ele, Time: p.Time}
+	}
+	return &gpx.GPX{
+		Version:  "1.1",
+		Creator:  "gpx-utils",
+		Metadata: metadata,
+		Trk:      []*gpx.TrkType{{Name: name, TrkSeg: []*gpx.TrkSegType{seg}}},
+	}
+}
+
+// WriteGPX writes g to w with an XML header.
+func WriteGPX(w io.Writer, g *gpx.GPX) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	return g.WriteIndent(w, "", "  ")
+}
+
+// UpdateDistances recalculates the distance of each point from the start of the track.
+func UpdateDistances(points []Point) {
+	for i := range points {
+		if i == 0 {
+			points[i].Distance = 0
+			continue
+		}
+		points[i].Distance = points[i-1].Distance + Distance(points[i-1], points[i])
+	}
+}
+
+// Distance returns the distance (in metres) between p and q on the National Grid.
+func Distance(p, q Point) float64 {
+	dx := p.Easting - q.Easting
+	dy := p.Northing - q.Northing
+	return math.Sqrt(dx*dx + dy*dy)
+}
@@ -0,0 +1,122 @@
+package webui
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/ray1729/gpx-utils/pkg/track"
+)
+
+// Dimensions of the elevation chart, and the margins left for the axis labels
+const (
+	chartWidth   = 800
+	chartHeight  = 200
+	marginLeft   = 45
+	marginRight  = 10
+	marginTop    = 10
+	marginBottom = 25
+)
+
+// Most points drawn on the chart; longer tracks are sampled
+const maxProfilePoints = 500
+
+// Smallest range of elevation (m) shown, so that flat routes look flat
+const minElevationRange = 50
+
+// profile is an elevation chart drawn as SVG. Line and Area are the points attributes of the
+// polyline and polygon drawing the track.
+type profile struct {
+	Width  int
+	Height int
+	Left   float64
+	Right  float64
+	Top    float64
+	Bottom float64
+	Line   string
+	Area   string
+	XTicks []tick
+	YTicks []tick
+}
+
+// tick is a labelled position on an axis of the chart.
+type tick struct {
+	Pos   float64
+	Label string
+}
+
+// newProfile returns the elevation chart of points, or nil if the track has no length.
+func newProfile(points []track.Point) *profile {
+	if len(points) < 2 || points[len(points)-1].Distance <= 0 {
+		return nil
+	}
+	points = samplePoints(points, maxProfilePoints)
+	distance := points[len(points)-1].Distance
+	minEle, maxEle := points[0].Ele, points[0].Ele
+	for _, p := range points {
+		minEle = math.Min(minEle, p.Ele)
+		maxEle = math.Max(maxEle, p.Ele)
+	}
+	lo := math.Floor(minEle/10) * 10
+	hi := math.Max(math.Ceil(maxEle/10)*10, lo+minElevationRange)
+
+	pr := &profile{
+		Width:  chartWidth,
+		Height: chartHeight,
+		Left:   marginLeft,
+		Right:  chartWidth - marginRight,
+		Top:    marginTop,
+		Bottom: chartHeight - marginBottom,
+	}
+	x := func(d float64) float64 {
+		return round1(pr.Left + (pr.Right-pr.Left)*d/distance)
+	}
+	y := func(e float64) float64 {
+		return round1(pr.Bottom - (pr.Bottom-pr.Top)*(e-lo)/(hi-lo))
+	}
+	var line strings.Builder
+	for i, p := range points {
+		if i > 0 {
+			line.WriteByte(' ')
+		}
+		fmt.Fprintf(&line, "%g,%g", x(p.Distance), y(p.Ele))
+	}
+	pr.Line = line.String()
+	pr.Area = fmt.Sprintf("%g,%g %s %g,%g", pr.Left, pr.Bottom, pr.Line, pr.Right, pr.Bottom)
+
+	step := tickStep(distance / 1000)
+	for d := 0.0; d <= distance/1000; d += step {
+		pr.XTicks = append(pr.XTicks, tick{Pos: x(d * 1000), Label: fmt.Sprintf("%gkm", d)})
+	}
+	for _, e := range []float64{lo, (lo + hi) / 2, hi} {
+		pr.YTicks = append(pr.YTicks, tick{Pos: y(e), Label: fmt.Sprintf("%.0fm", e)})
+	}
+	return pr
+}
+
+// samplePoints returns at most n points of a track, evenly spaced along it and including the
+// first and last points.
+func samplePoints(points []track.Point, n int) []track.Point {
+	if len(points) <= n {
+		return points
+	}
+	sampled := make([]track.Point, 0, n)
+	for i := 0; i < n-1; i++ {
+		sampled = append(sampled, points[i*(len(points)-1)/(n-1)])
+	}
+	return append(sampled, points[len(points)-1])
+}
+
+// tickStep returns the distance (km) between labels on the distance axis, giving at most 10.
+func tickStep(km float64) float64 {
+	for _, step := range []float64{1, 2, 5, 10, 20, 25, 50, 100, 200, 500} {
+		if km/step <= 10 {
+			return step
+		}
+	}
+	return 1000
+}
+
+func round1(v float64) float64 {
+	return math.Round(v*10) / 10
+}
@@ -0,0 +1,256 @@
+// Package webui serves an HTML front end to the route summarizer, so routes can be summarized
+// from a browser. The templates and stylesheet are embedded in the binary.
+package webui
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/fofanov/go-osgb"
+	"github.com/twpayne/go-gpx"
+
+	"github.com/ray1729/gpx-utils/pkg/placenames"
+	"github.com/ray1729/gpx-utils/pkg/requestid"
+	"github.com/ray1729/gpx-utils/pkg/rwgps"
+	"github.com/ray1729/gpx-utils/pkg/track"
+)
+
+//go:embed templates static widgets
+var content embed.FS
+
+// The fields read from a POSTed form, with the same meaning as the /rwgps parameters
+var formFields = []string{"url", "stops", "sr", "sdd", "dd", "md", "ms"}
+
+// Allowance for the form fields sent along with an uploaded file
+const formOverhead = 64 << 10
+
+type Handler struct {
+	rwgps  *rwgps.RWGPSHandler
+	tmpl   *template.Template
+	static http.Handler
+	trans  osgb.CoordinateTransformer
+}
+
+// NewHandler returns a handler serving the front end, which fetches and summarizes routes
+// with h. It expects to be mounted at the root of the server.
+func NewHandler(h *rwgps.RWGPSHandler) (*Handler, error) {
+	tmpl, err := template.New("index.html").Funcs(funcs).ParseFS(content, "templates/*.html")
+	if err != nil {
+		return nil, fmt.Errorf("error parsing templates: %v", err)
+	}
+	static, err := fs.Sub(content, "static")
+	if err != nil {
+		return nil, err
+	}
+	trans, err := osgb.NewOSTN15Transformer()
+	if err != nil {
+		return nil, fmt.Errorf("error constructing coordinate transformer: %v", err)
+	}
+	return &Handler{
+		rwgps:  h,
+		tmpl:   tmpl,
+		static: http.StripPrefix("/static/", http.FileServer(http.FS(static))),
+		trans:  trans,
+	}, nil
+}
+
+// page is the data rendered by the index template.
+type page struct {
+	Params   url.Values
+	Summary  *placenames.TrackSummary
+	Counties []county
+	Profile  *profile
+	JSONLink string
+	Error    string
+}
+
+type county struct {
+	Name    string
+	Percent int
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/static/") {
+		h.static.ServeHTTP(w, r)
+		return
+	}
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		q := r.URL.Query()
+		if q.Get("url") == "" {
+			h.render(w, r, http.StatusOK, &page{Params: q})
+			return
+		}
+		h.summarize(w, r, q, nil)
+	case http.MethodPost:
+		q, upload, err := h.readForm(w, r)
+		if err != nil {
+			requestid.Printf(r.Context(), "Error reading form: %v", err)
+			status := http.StatusBadRequest
+			if errors.Is(err, rwgps.ErrTrackTooLarge) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			h.render(w, r, status, &page{Params: q, Error: err.Error()})
+			return
+		}
+		h.summarize(w, r, q, upload)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// readForm returns the route URL and settings submitted in a POSTed form, along with the
+// uploaded GPX file if there is one.
+func (h *Handler) readForm(w http.ResponseWriter, r *http.Request) (url.Values, []byte, error) {
+	maxSize := h.rwgps.Config().MaxSize
+	q := make(url.Values)
+	if r.ContentLength > maxSize+formOverhead {
+		return q, nil, rwgps.ErrTrackTooLarge
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+formOverhead)
+	if err := r.ParseMultipartForm(maxSize); err != nil && err != http.ErrNotMultipart {
+		return q, nil, fmt.Errorf("error reading form: %v", err)
+	}
+	for _, name := range formFields {
+		if v := strings.TrimSpace(r.PostFormValue(name)); v != "" {
+			q.Set(name, v)
+		}
+	}
+	f, _, err := r.FormFile("gpx")
+	if err == http.ErrMissingFile || err == http.ErrNotMultipart {
+		if q.Get("url") == "" {
+			return q, nil, errors.New("enter a route address or choose a GPX file")
+		}
+		return q, nil, nil
+	}
+	if err != nil {
+		return q, nil, fmt.Errorf("error reading upload: %v", err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(f, maxSize+1))
+	if err != nil {
+		return q, nil, fmt.Errorf("error reading upload: %v", err)
+	}
+	if int64(len(data)) > maxSize {
+		return q, nil, rwgps.ErrTrackTooLarge
+	}
+	// An uploaded file takes precedence over a URL
+	q.Del("url")
+	return q, data, nil
+}
+
+// summarize renders the summary of the uploaded track, or if there is none the route
+// identified by the url parameter.
+func (h *Handler) summarize(w http.ResponseWriter, r *http.Request, q url.Values, upload []byte) {
+	ctx := r.Context()
+	if timeout := h.rwgps.Config().Timeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	p := &page{Params: q}
+	data := upload
+	if data == nil {
+		requestid.Printf(ctx, "Handling web request for %s stops=%s", q.Get("url"), q.Get("stops"))
+		var err error
+		data, err = h.rwgps.Track(ctx, q)
+		if err != nil {
+			h.renderError(w, r, p, err)
+			return
+		}
+		p.JSONLink = "/rwgps?" + q.Encode()
+	} else {
+		requestid.Printf(ctx, "Handling web upload stops=%s", q.Get("stops"))
+	}
+	summary, err := h.rwgps.Summarize(ctx, q, data)
+	if err != nil {
+		h.renderError(w, r, p, err)
+		return
+	}
+	p.Summary = summary
+	p.Counties = sortCounties(summary.Counties)
+	p.Profile, err = h.profile(data)
+	if err != nil {
+		requestid.Printf(ctx, "Error drawing elevation profile: %v", err)
+	}
+	h.render(w, r, http.StatusOK, p)
+}
+
+// profile returns the elevation profile of a GPX track.
+func (h *Handler) profile(data []byte) (*profile, error) {
+	g, err := gpx.Read(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	points, err := track.FromGPX(g, h.trans)
+	if err != nil {
+		return nil, err
+	}
+	return newProfile(points), nil
+}
+
+func (h *Handler) renderError(w http.ResponseWriter, r *http.Request, p *page, err error) {
+	requestid.Printf(r.Context(), "Error summarizing route: %v", err)
+	status, detail := rwgps.ErrorResponse(err)
+	if status == 0 {
+		return
+	}
+	p.Error = detail
+	h.render(w, r, status, p)
+}
+
+func (h *Handler) render(w http.ResponseWriter, r *http.Request, status int, p *page) {
+	var buf bytes.Buffer
+	if err := h.tmpl.Execute(&buf, p); err != nil {
+		requestid.Printf(r.Context(), "Error rendering template: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// sortCounties orders counties by the percentage of the route in each, largest first.
+func sortCounties(m map[string]int) []county {
+	var counties []county
+	for name, percent := range m {
+		counties = append(counties, county{Name: name, Percent: percent})
+	}
+	sort.Slice(counties, func(i, j int) bool {
+		if counties[i].Percent != counties[j].Percent {
+			return counties[i].Percent > counties[j].Percent
+		}
+		return counties[i].Name < counties[j].Name
+	})
+	return counties
+}
+
+var funcs = template.FuncMap{
+	"km": func(d float64) string {
+		return fmt.Sprintf("%.1f", d)
+	},
+	"hours": func(h float64) string {
+		m := int(h*60 + 0.5)
+		return fmt.Sprintf("%dh %02dm", m/60, m%60)
+	},
+	"list": func(items ...string) []string {
+		return items
+	},
+}
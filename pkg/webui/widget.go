@@ -0,0 +1,225 @@
+package webui
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ray1729/gpx-utils/pkg/placenames"
+	"github.com/ray1729/gpx-utils/pkg/requestid"
+	"github.com/ray1729/gpx-utils/pkg/rwgps"
+)
+
+// Widget serves route summaries that club websites can embed: an HTML fragment at /widget,
+// or a script at /widget.js that writes the fragment into the page. With a callback
+// parameter, either returns JSONP instead.
+type Widget struct {
+	rwgps *rwgps.RWGPSHandler
+	tmpl  *template.Template
+}
+
+// NewWidget returns a handler serving widgets summarized with h. Each NAME.html file in dir,
+// if dir is not empty, is a template selected by the parameter template=NAME, so that each
+// club can lay out and style its own widget. A default.html in dir replaces the built-in
+// template.
+func NewWidget(h *rwgps.RWGPSHandler, dir string) (*Widget, error) {
+	tmpl, err := template.New("default.html").Funcs(funcs).ParseFS(content, "widgets/*.html")
+	if err != nil {
+		return nil, fmt.Errorf("error parsing widget templates: %v", err)
+	}
+	if dir != "" {
+		files, err := filepath.Glob(filepath.Join(dir, "*.html"))
+		if err != nil {
+			return nil, fmt.Errorf("error listing widget templates: %v", err)
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no widget templates (*.html) in %s", dir)
+		}
+		if tmpl, err = tmpl.ParseFiles(files...); err != nil {
+			return nil, fmt.Errorf("error parsing widget templates: %v", err)
+		}
+		log.Printf("Loaded %d widget templates from %s", len(files), dir)
+	}
+	return &Widget{rwgps: h, tmpl: tmpl}, nil
+}
+
+// widget is the data rendered by a widget template.
+type widget struct {
+	Summary *placenames.TrackSummary
+	Link    string           // the route's web page
+	Via     []placenames.POI // the places passed through, without the start and finish
+	Params  url.Values       // the request parameters, for templates that take options
+}
+
+// jsonp is the object passed to a JSONP callback.
+type jsonp struct {
+	HTML    string                   `json:"html"`
+	Summary *placenames.TrackSummary `json:"summary"`
+}
+
+// A JavaScript identifier or dotted path, such as myClub.showRoute
+var callbackRE = regexp.MustCompile(`^[A-Za-z_$][\w$]*(\.[A-Za-z_$][\w$]*)*$`)
+
+func (wg *Widget) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	name := q.Get("template")
+	if name == "" {
+		name = "default"
+	}
+	tmpl := wg.tmpl.Lookup(name + ".html")
+	if tmpl == nil || strings.ContainsAny(name, `/\`) {
+		wg.error(w, http.StatusBadRequest, "unknown template: "+name)
+		return
+	}
+	callback := q.Get("callback")
+	if callback != "" && (len(callback) > 64 || !callbackRE.MatchString(callback)) {
+		wg.error(w, http.StatusBadRequest, "invalid callback: "+callback)
+		return
+	}
+	ctx := r.Context()
+	if timeout := wg.rwgps.Config().Timeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	summary, status, err := wg.rwgps.Summary(ctx, q)
+	if err != nil {
+		code, detail := rwgps.ErrorResponse(err)
+		if code == 0 {
+			return
+		}
+		wg.error(w, code, detail)
+		return
+	}
+	if status != "" {
+		w.Header().Set("X-Cache", string(status))
+	}
+	data := &widget{Summary: summary, Link: summary.Link, Via: via(summary), Params: q}
+	if data.Link == "" {
+		data.Link = wg.rwgps.Link(q)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		requestid.Printf(ctx, "Error rendering widget template %s: %v", name, err)
+		wg.error(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	switch {
+	case callback != "":
+		body, err := json.Marshal(jsonp{HTML: buf.String(), Summary: summary})
+		if err != nil {
+			requestid.Printf(ctx, "Error marshalling JSON: %v", err)
+			wg.error(w, http.StatusInternalServerError, "internal error")
+			return
+		}
+		wg.write(w, r, "application/javascript; charset=utf-8", []byte(fmt.Sprintf("/**/%s(%s);\n", callback, body)))
+	case strings.HasSuffix(r.URL.Path, ".js"):
+		body, err := script(buf.String(), q.Get("target"))
+		if err != nil {
+			requestid.Printf(ctx, "Error marshalling JSON: %v", err)
+			wg.error(w, http.StatusInternalServerError, "internal error")
+			return
+		}
+		wg.write(w, r, "application/javascript; charset=utf-8", body)
+	default:
+		wg.write(w, r, "text/html; charset=utf-8", buf.Bytes())
+	}
+}
+
+// script returns JavaScript that writes html into the element with id target, or if target
+// is empty, inserts it before the script tag that loaded it.
+func script(html, target string) ([]byte, error) {
+	h, err := json.Marshal(html)
+	if err != nil {
+		return nil, err
+	}
+	t, err := json.Marshal(target)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf(`(function() {
+  var html = %s, target = %s, s = document.currentScript;
+  var el = target ? document.getElementById(target) : null;
+  if (el) {
+    el.innerHTML = html;
+  } else if (s) {
+    var d = document.createElement("div");
+    d.innerHTML = html;
+    s.parentNode.insertBefore(d, s);
+  }
+})();
+`, h, t)), nil
+}
+
+// via returns the places of interest along the route, leaving out the start and finish.
+func via(s *placenames.TrackSummary) []placenames.POI {
+	pois := s.PointsOfInterest
+	if len(pois) > 0 && pois[0].Name == s.Start {
+		pois = pois[1:]
+	}
+	if len(pois) > 0 && pois[len(pois)-1].Name == s.Finish {
+		pois = pois[:len(pois)-1]
+	}
+	return pois
+}
+
+// write sends body with an ETag, answering a conditional request with 304 Not Modified if
+// the client already has it. Widgets may be cached for as long as the summaries they show,
+// but only by the browser if the route is private or the request was authenticated.
+func (wg *Widget) write(w http.ResponseWriter, r *http.Request, contentType string, body []byte) {
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	h := w.Header()
+	h.Set("ETag", etag)
+	if ttl := wg.rwgps.Config().CacheTTL; ttl > 0 {
+		scope := "public"
+		if wg.rwgps.Private(r.URL.Query()) || r.Header.Get("Authorization") != "" {
+			scope = "private"
+		}
+		h.Set("Cache-Control", scope+", max-age="+strconv.Itoa(int(ttl.Seconds())))
+	} else {
+		h.Set("Cache-Control", "no-cache")
+	}
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// etagMatch reports whether the If-None-Match header matches etag.
+func etagMatch(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == etag || t == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// error reports a failure as plain text, which is not cached.
+func (wg *Widget) error(w http.ResponseWriter, status int, detail string) {
+	w.Header().Set("Cache-Control", "no-store")
+	http.Error(w, detail, status)
+}